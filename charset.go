@@ -0,0 +1,54 @@
+package syntax
+
+import (
+	"fmt"
+	"sync"
+)
+
+// A string field tagged with `charset=name` may only contain characters
+// that the named charset accepts.  The "ascii" charset is registered by
+// default; others can be registered with RegisterCharset:
+//
+//	RegisterCharset("digits", func(r rune) bool { return r >= '0' && r <= '9' })
+//
+// Strings are checked character by character, as UTF-8.  Bytes that are not
+// valid UTF-8 are checked as utf8.RuneError.
+
+var (
+	charsetMutex    sync.RWMutex
+	charsetRegistry = map[string]func(rune) bool{
+		charsetASCII: func(r rune) bool { return r < 0x80 },
+	}
+)
+
+var charsetASCII = "ascii"
+
+// RegisterCharset registers a charset under the specified name, for use
+// with the `charset` tag.  The function reports whether a character is in
+// the charset.
+func RegisterCharset(name string, valid func(r rune) bool) {
+	charsetMutex.Lock()
+	defer charsetMutex.Unlock()
+	charsetRegistry[name] = valid
+}
+
+func lookupCharset(name string) func(rune) bool {
+	charsetMutex.RLock()
+	defer charsetMutex.RUnlock()
+
+	valid, ok := charsetRegistry[name]
+	if !ok {
+		panic(fmt.Errorf("Unknown charset: %s", name))
+	}
+	return valid
+}
+
+// checkCharset verifies that every character in s is in the named charset
+func checkCharset(s string, name string) {
+	valid := lookupCharset(name)
+	for i, r := range s {
+		if !valid(r) {
+			panic(fmt.Errorf("String contains character outside charset %s at index %d: %q", name, i, r))
+		}
+	}
+}
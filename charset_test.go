@@ -0,0 +1,51 @@
+package syntax
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	RegisterCharset("digits", func(r rune) bool { return r >= '0' && r <= '9' })
+}
+
+func TestCharset(t *testing.T) {
+	type asciiString struct {
+		V string `tls:"head=1,charset=ascii"`
+	}
+	type digitString struct {
+		V string `tls:"head=1,charset=digits"`
+	}
+
+	// Valid strings round-trip
+	encoding, err := Marshal(asciiString{V: "hello"})
+	require.Nil(t, err)
+	require.Equal(t, encoding, unhex("0568656c6c6f"))
+
+	var ascii asciiString
+	_, err = Unmarshal(encoding, &ascii)
+	require.Nil(t, err)
+	require.Equal(t, ascii.V, "hello")
+
+	var digits digitString
+	_, err = Unmarshal(unhex("03313233"), &digits)
+	require.Nil(t, err)
+	require.Equal(t, digits.V, "123")
+
+	// Characters outside the charset are rejected
+	_, err = Unmarshal(unhex("0568656cEC6f"), &ascii)
+	require.NotNil(t, err)
+
+	_, err = Unmarshal(unhex("03313a33"), &digits)
+	require.NotNil(t, err)
+
+	_, err = Marshal(asciiString{V: "héllo"})
+	require.NotNil(t, err)
+
+	// Unknown charsets are rejected
+	_, err = Marshal(struct {
+		V string `tls:"head=1,charset=ebcdic"`
+	}{})
+	require.NotNil(t, err)
+}
@@ -0,0 +1,76 @@
+package syntax
+
+import (
+	"fmt"
+	"hash/crc32"
+	"reflect"
+	"strings"
+)
+
+// A checksum field holds a CRC-32 (IEEE) of the encodings of earlier fields
+// in the same struct:
+//
+//	type Record struct {
+//		Type   uint8
+//		Body   []byte `tls:"head=2"`
+//		Length uint16
+//		CRC    uint32 `tls:"checksum-over=Type..Body"`
+//	}
+//
+// With the `checksum` tag, the checksum covers all of the preceding fields.
+// With `checksum-over=First..Last`, it covers the fields from First through
+// Last, inclusive.  In either case, the headers of any groups are not
+// covered.  On decode, the checksum is recomputed and must match.
+
+// checksumRange is the range of fields covered by a checksum field
+type checksumRange struct {
+	first, last int
+}
+
+// parseChecksumRange parses the value of a `checksum-over` tag
+func parseChecksumRange(val string) (string, string) {
+	parts := strings.Split(val, "..")
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		panic(fmt.Errorf("Malformed checksum range: %s", val))
+	}
+	return parts[0], parts[1]
+}
+
+// checksumFields returns the range of fields covered by the checksum in
+// field i of the struct type t, or nil if the field is not a checksum
+func checksumFields(t reflect.Type, i int, opts fieldOptions) *checksumRange {
+	if !opts.checksum {
+		return nil
+	}
+
+	if opts.checksumFirst == "" {
+		if i == 0 {
+			panic(fmt.Errorf("Checksum must follow the fields it covers"))
+		}
+		return &checksumRange{0, i - 1}
+	}
+
+	first := checksumFieldIndex(t, i, opts.checksumFirst)
+	last := checksumFieldIndex(t, i, opts.checksumLast)
+	if first > last {
+		panic(fmt.Errorf("Checksum range is reversed: %s..%s", opts.checksumFirst, opts.checksumLast))
+	}
+	return &checksumRange{first, last}
+}
+
+func checksumFieldIndex(t reflect.Type, i int, name string) int {
+	f, ok := t.FieldByName(name)
+	if !ok || len(f.Index) != 1 || f.Index[0] >= i {
+		panic(fmt.Errorf("Checksum field %s must be an earlier field", name))
+	}
+	return f.Index[0]
+}
+
+// sum computes the checksum over the encodings of the covered fields
+func (r checksumRange) sum(fieldData [][]byte) uint64 {
+	h := crc32.NewIEEE()
+	for i := r.first; i <= r.last; i += 1 {
+		h.Write(fieldData[i])
+	}
+	return uint64(h.Sum32())
+}
@@ -0,0 +1,93 @@
+package syntax
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type checksumTestAll struct {
+	Type uint8
+	Body []byte `tls:"head=2"`
+	CRC  uint32 `tls:"checksum"`
+}
+
+type checksumTestRange struct {
+	Type    uint8
+	Body    []byte `tls:"head=2"`
+	Extra   uint16
+	Trailer uint8
+	CRC     uint32 `tls:"checksum-over=Body..Extra"`
+}
+
+func TestChecksum(t *testing.T) {
+	cases := map[string]struct {
+		value    interface{}
+		decoded  interface{}
+		encoding []byte
+	}{
+		"all": {
+			value:    checksumTestAll{Type: 0x01, Body: []byte{0xC0, 0xC1, 0xC2}},
+			decoded:  &checksumTestAll{},
+			encoding: unhex("01" + "0003C0C1C2" + "5e0f0e3b"),
+		},
+		"range": {
+			value:    checksumTestRange{Type: 0x01, Body: []byte{0xC0, 0xC1, 0xC2}, Extra: 0xB0B1, Trailer: 0xD0},
+			decoded:  &checksumTestRange{},
+			encoding: unhex("01" + "0003C0C1C2" + "B0B1" + "D0" + "f694a3e4"),
+		},
+	}
+
+	for label, testCase := range cases {
+		encoding, err := Marshal(testCase.value)
+		require.Nil(t, err, label)
+		require.Equal(t, encoding, testCase.encoding, label)
+
+		read, err := Unmarshal(encoding, testCase.decoded)
+		require.Nil(t, err, label)
+		require.Equal(t, read, len(encoding), label)
+
+		// Fields outside the range are not covered by the checksum
+		if decoded, ok := testCase.decoded.(*checksumTestRange); ok {
+			require.Equal(t, decoded.CRC, uint32(0xf694a3e4), label)
+			decoded.CRC = 0
+			require.Equal(t, *decoded, testCase.value, label)
+
+			encoding[0] ^= 0xFF
+			encoding[len(encoding)-5] ^= 0xFF
+			_, err = Unmarshal(encoding, testCase.decoded)
+			require.Nil(t, err, label)
+		}
+	}
+}
+
+func TestChecksumErrors(t *testing.T) {
+	// Corrupted field
+	var decoded checksumTestRange
+	_, err := Unmarshal(unhex("01"+"0003C0C1C3"+"B0B1"+"D0"+"f694a3e4"), &decoded)
+	require.NotNil(t, err)
+
+	// Corrupted checksum
+	_, err = Unmarshal(unhex("01"+"0003C0C1C2"+"B0B1"+"D0"+"f694a3e5"), &decoded)
+	require.NotNil(t, err)
+
+	// Range must precede the checksum
+	_, err = Marshal(struct {
+		CRC  uint32 `tls:"checksum-over=Type..Type"`
+		Type uint8
+	}{})
+	require.NotNil(t, err)
+
+	// Checksum must have fields to cover
+	_, err = Marshal(struct {
+		CRC uint32 `tls:"checksum"`
+	}{})
+	require.NotNil(t, err)
+
+	// Checksum must be a uint32
+	_, err = Marshal(struct {
+		Type uint8
+		CRC  uint16 `tls:"checksum"`
+	}{})
+	require.NotNil(t, err)
+}
@@ -2,6 +2,8 @@ package syntax
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"reflect"
 	"runtime"
@@ -9,12 +11,130 @@ import (
 )
 
 func Unmarshal(data []byte, v interface{}) (int, error) {
+	return UnmarshalWithOptions(data, v, DecodeOptions{})
+}
+
+// DecodeOptions control how UnmarshalWithOptions interprets its input.
+type DecodeOptions struct {
+	// Strict causes non-canonical encodings, such as a varint that is longer
+	// than necessary, to be rejected.  Otherwise, they are accepted and
+	// reported as warnings.
+	Strict bool
+
+	// Warnings, if non-nil, accumulates the non-fatal anomalies encountered
+	// while decoding.
+	Warnings *[]Warning
+
+	// ByteOrder is the byte order for fixed-width integers and length
+	// headers, except in fields tagged `le` or `be`.
+	ByteOrder ByteOrder
+
+	// Allocated, if non-nil, accumulates the number of bytes of memory
+	// allocated for decoded slices and maps.
+	Allocated *int
+
+	// Alloc, if non-nil, is called to allocate the memory for decoded byte
+	// slices, including the contents of Lazy values, which are then copied
+	// out of the input.  It must return a slice of the requested size.
+	// Other slices, maps, and strings are allocated by the runtime.
+	Alloc func(size int) []byte
+
+	// VerifyRoundtrip causes each decoded value to be re-encoded and
+	// compared against the data it was decoded from, as a check on the
+	// consistency of custom codecs.  It is intended for testing.
+	VerifyRoundtrip bool
+
+	// Resync bounds a custom unmarshaler in a field with a `head` tag to the
+	// region that the header delimits.  If the unmarshaler does not consume
+	// the whole region, decoding resumes at the end of the region and a
+	// warning is recorded, rather than failing.
+	Resync bool
+
+	// MaxSize, if non-zero, bounds the total memory allocated for decoded
+	// slices and maps, as counted by Allocated.  Decoding fails once the
+	// bound is exceeded.
+	MaxSize int
+
+	// MaxDepth bounds the nesting of structs, vectors, and maps in the
+	// decoded value, so that hostile input cannot exhaust the stack.  If
+	// zero, DefaultMaxDepth applies.
+	MaxDepth int
+}
+
+// DefaultMaxDepth is the nesting depth allowed when DecodeOptions.MaxDepth
+// is not set.
+const DefaultMaxDepth = 10000
+
+// A Warning describes a suspicious but non-fatal condition encountered while
+// decoding.
+type Warning struct {
+	Offset  int // offset in the input at which the condition was found
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("offset %d: %s", w.Offset, w.Message)
+}
+
+func UnmarshalWithOptions(data []byte, v interface{}, opts DecodeOptions) (int, error) {
 	// Check for well-formedness.
 	// Avoids filling out half a data structure
 	// before discovering a JSON syntax error.
-	d := decodeState{}
-	d.Write(data)
-	return d.unmarshal(v)
+	d := newDecodeState(data, opts)
+	read, err := d.unmarshal(v)
+	if err != nil || !opts.VerifyRoundtrip {
+		return read, err
+	}
+
+	if err := verifyRoundtrip(data[:read], v, opts); err != nil {
+		return 0, err
+	}
+	return read, nil
+}
+
+// verifyRoundtrip checks that the value v decoded from data encodes to data
+func verifyRoundtrip(data []byte, v interface{}, opts DecodeOptions) error {
+	// Encode through the pointer, so that methods with pointer receivers
+	// apply as they did on decode
+	encoded, err := MarshalWithOptions(v, EncodeOptions{ByteOrder: opts.ByteOrder})
+	if err != nil {
+		return fmt.Errorf("Decoded value cannot be re-encoded: %v", err)
+	}
+
+	if bytes.Equal(data, encoded) {
+		return nil
+	}
+
+	offset := 0
+	for offset < len(data) && offset < len(encoded) && data[offset] == encoded[offset] {
+		offset += 1
+	}
+	return fmt.Errorf("Re-encoding differs from input at offset %d", offset)
+}
+
+// Appender is the interface implemented by collections that receive the
+// elements of a vector one at a time as they are decoded, instead of being
+// decoded as a slice.  NewElementTLS returns a pointer to a new element to
+// decode into, and AppendTLS receives the decoded element (the value, not the
+// pointer).  A field of such a type takes the same header tags as a slice.
+// Appender is only used for decoding.
+type Appender interface {
+	NewElementTLS() interface{}
+	AppendTLS(elem interface{})
+}
+
+// UnmarshalSlice decodes a sequence of concatenated messages, appending
+// them to the slice that out points to, until data is exhausted.  If any of
+// the messages cannot be decoded, including a partial message at the end of
+// data, the slice is left unchanged.
+func UnmarshalSlice(data []byte, out interface{}) (int, error) {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Slice {
+		return 0, fmt.Errorf("Invalid unmarshal target (non-pointer to slice or nil)")
+	}
+
+	d := newDecodeState(data, DecodeOptions{})
+	return d.unmarshalSlice(rv)
 }
 
 // Unmarshaler is the interface implemented by types that can
@@ -28,6 +148,130 @@ type Unmarshaler interface {
 
 type decodeState struct {
 	bytes.Buffer
+	opts DecodeOptions
+	end  int // offset in the input of the end of this state's data
+
+	// If non-nil, records the length of input that would have been needed
+	// to satisfy a read past the end of the data, so that a stream can
+	// supply more.  Only the outermost state records this, since the data
+	// in a sub-state is bounded by a header.
+	needed *int
+
+	// Shared among a state and its sub-states
+	limits *decodeLimits
+}
+
+// decodeLimits tracks the resources used by a decode, for comparison against
+// the limits in DecodeOptions
+type decodeLimits struct {
+	allocated int
+	depth     int
+}
+
+func newDecodeState(data []byte, opts DecodeOptions) *decodeState {
+	if opts.MaxDepth == 0 {
+		opts.MaxDepth = DefaultMaxDepth
+	}
+
+	d := &decodeState{opts: opts, end: len(data), limits: &decodeLimits{}}
+	d.Write(data)
+	return d
+}
+
+// offset returns the current position in the input
+func (d *decodeState) offset() int {
+	return d.end - d.Len()
+}
+
+// Next returns the next n bytes of the data, or all of the remaining data if
+// there are fewer than n bytes
+func (d *decodeState) Next(n int) []byte {
+	d.need(n)
+	return d.Buffer.Next(n)
+}
+
+// peek returns the next n bytes without consuming them, or nil if there are
+// fewer than n bytes
+func (d *decodeState) peek(n int) []byte {
+	d.need(n)
+	if d.Len() < n {
+		return nil
+	}
+	return d.Bytes()[:n]
+}
+
+// need records a shortfall if fewer than n bytes remain
+func (d *decodeState) need(n int) {
+	if d.needed != nil && n > d.Len() && d.offset()+n > *d.needed {
+		*d.needed = d.offset() + n
+	}
+}
+
+// sub returns a decodeState for data that has just been read from d, e.g.,
+// the body of a vector
+func (d *decodeState) sub(data []byte) *decodeState {
+	s := &decodeState{opts: d.opts, end: d.offset(), limits: d.limits}
+	s.Write(data)
+	return s
+}
+
+// allocate records the allocation of memory for a decoded value
+func (d *decodeState) allocate(size int) {
+	if d.opts.Allocated != nil {
+		*d.opts.Allocated += size
+	}
+
+	d.limits.allocated += size
+	if d.opts.MaxSize > 0 && d.limits.allocated > d.opts.MaxSize {
+		panic(fmt.Errorf("Decoded size exceeds maximum [%d > %d]", d.limits.allocated, d.opts.MaxSize))
+	}
+}
+
+// enter records entry into a nested value, failing if it is nested too
+// deeply.  Each call must be matched by a call to leave.
+func (d *decodeState) enter() {
+	d.limits.depth += 1
+	if d.limits.depth > d.opts.MaxDepth {
+		panic(fmt.Errorf("Nesting depth exceeds maximum [%d]", d.opts.MaxDepth))
+	}
+}
+
+func (d *decodeState) leave() {
+	d.limits.depth -= 1
+}
+
+// allocBytes returns the decoded byte slice for data read from d, copied into
+// memory from the allocator if there is one
+func (d *decodeState) allocBytes(data []byte) []byte {
+	if d.opts.Alloc == nil {
+		return data
+	}
+
+	buf := d.opts.Alloc(len(data))
+	if len(buf) != len(data) {
+		panic(fmt.Errorf("Allocator returned %d bytes, expected %d", len(buf), len(data)))
+	}
+
+	copy(buf, data)
+	return buf
+}
+
+// nonCanonical reports a non-canonical encoding found at the indicated
+// offset, either as an error in strict mode or as a warning otherwise
+func (d *decodeState) nonCanonical(offset int, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if d.opts.Strict {
+		panic(fmt.Errorf("Non-canonical encoding: %s", msg))
+	}
+
+	d.warn(offset, msg)
+}
+
+// warn records a warning at the specified offset, if warnings are collected
+func (d *decodeState) warn(offset int, msg string) {
+	if d.opts.Warnings != nil {
+		*d.opts.Warnings = append(*d.opts.Warnings, Warning{Offset: offset, Message: msg})
+	}
 }
 
 func (d *decodeState) unmarshal(v interface{}) (read int, err error) {
@@ -52,6 +296,32 @@ func (d *decodeState) unmarshal(v interface{}) (read int, err error) {
 	return read, nil
 }
 
+func (d *decodeState) unmarshalSlice(v reflect.Value) (read int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+			if s, ok := r.(string); ok {
+				panic(s)
+			}
+			read, err = 0, r.(error)
+		}
+	}()
+
+	elemType := v.Elem().Type().Elem()
+	dec := typeDecoder(elemType)
+	messages := v.Elem()
+	for i := 0; d.Len() > 0; i += 1 {
+		elem := reflect.New(elemType)
+		read += decodeElement(d, dec, elem, fieldOptions{}, i)
+		messages = reflect.Append(messages, elem.Elem())
+	}
+
+	v.Elem().Set(messages)
+	return read, nil
+}
+
 func (e *decodeState) value(v reflect.Value) int {
 	return valueDecoder(v)(e, v, fieldOptions{})
 }
@@ -69,27 +339,61 @@ func typeDecoder(t reflect.Type) decoderFunc {
 		return fi.(decoderFunc)
 	}
 
-	// XXX(RLB): Wait group based support for recursive types omitted
+	// As in typeEncoder, an indirect func stands in for the decoder while it
+	// is being built, so that recursive types can refer to it
+	var (
+		wg sync.WaitGroup
+		f  decoderFunc
+	)
+	wg.Add(1)
+	fi, loaded := decoderCache.LoadOrStore(t, decoderFunc(func(d *decodeState, v reflect.Value, opts fieldOptions) int {
+		wg.Wait()
+		return f(d, v, opts)
+	}))
+	if loaded {
+		return fi.(decoderFunc)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			decoderCache.Delete(t)
+			f = func(d *decodeState, v reflect.Value, opts fieldOptions) int { panic(r) }
+			wg.Done()
+			panic(r)
+		}
+	}()
 
 	// Compute the real decoder and replace the indirect func with it.
-	f := newTypeDecoder(t)
+	f = newTypeDecoder(t)
+	wg.Done()
 	decoderCache.Store(t, f)
 	return f
 }
 
 var (
 	unmarshalerType = reflect.TypeOf(new(Unmarshaler)).Elem()
+	appenderType    = reflect.TypeOf(new(Appender)).Elem()
 	uint8Type       = reflect.TypeOf(uint8(0))
 )
 
 func newTypeDecoder(t reflect.Type) decoderFunc {
 	var dec decoderFunc
-	if t.Kind() != reflect.Ptr && reflect.PtrTo(t).Implements(unmarshalerType) {
+	if t == lazyType {
+		dec = lazyDecoder
+	} else if t.Kind() != reflect.Ptr && reflect.PtrTo(t).Implements(unmarshalerType) {
 		dec = unmarshalerDecoder
+	} else if t.Kind() != reflect.Ptr && reflect.PtrTo(t).Implements(appenderType) {
+		dec = appenderDecoder
 	} else {
 		switch t.Kind() {
 		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 			dec = uintDecoder
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			dec = intDecoder
+		case reflect.Bool:
+			dec = boolDecoder
+		case reflect.String:
+			dec = stringDecoder
 		case reflect.Array:
 			dec = newArrayDecoder(t)
 		case reflect.Slice:
@@ -100,11 +404,17 @@ func newTypeDecoder(t reflect.Type) decoderFunc {
 			dec = newStructDecoder(t)
 		case reflect.Ptr:
 			dec = newPointerDecoder(t)
+		case reflect.Interface:
+			dec = taggedDecoder
 		default:
 			panic(fmt.Errorf("Unsupported type (%s)", t))
 		}
 	}
 
+	if info, ok := lookupEnum(t); ok {
+		dec = newEnumDecoder(dec, info)
+	}
+
 	if reflect.PtrTo(t).Implements(validatorType) {
 		dec = newValidatorDecoder(dec)
 	}
@@ -131,8 +441,8 @@ func unmarshalerDecoder(d *decodeState, v reflect.Value, opts fieldOptions) int
 		panic(err)
 	}
 
-	if read > d.Len() {
-		panic(fmt.Errorf("Invalid return value from UnmarshalTLS"))
+	if read < 0 || read > d.Len() {
+		panic(fmt.Errorf("Invalid return value from UnmarshalTLS: consumed %d bytes of %d", read, d.Len()))
 	}
 
 	d.Next(read)
@@ -151,7 +461,7 @@ func newValidatorDecoder(raw decoderFunc) decoderFunc {
 		}
 
 		if err := val.ValidForTLS(); err != nil {
-			panic(fmt.Errorf("Decoded invalid TLS value: %v", err))
+			panic(fmt.Errorf("Decoded invalid TLS value: %w", err))
 		}
 
 		return read
@@ -171,15 +481,25 @@ func uintDecoder(d *decodeState, v reflect.Value, opts fieldOptions) int {
 		panic(fmt.Errorf("Insufficient data to read uint"))
 	}
 
-	return setUintFromBuffer(v, buf)
+	v.Elem().SetUint(decodeUintWithOrder(buf, opts.byteOrder(d.opts.ByteOrder)))
+	return uintLen
 }
 
 func varintDecoder(d *decodeState, v reflect.Value, opts fieldOptions) int {
 	l, val := readVarint(d)
 
-	uintLen := int(v.Elem().Type().Size())
-	if uintLen < l {
-		panic(fmt.Errorf("Uint too small to fit varint: %d < %d", uintLen, l))
+	switch {
+	case opts.varintPad > 0 && l != opts.varintPad:
+		panic(fmt.Errorf("Padded varint has wrong length: %d != %d", l, opts.varintPad))
+	case opts.varintPad == 0:
+		checkMinimalVarint(d, l, val)
+	}
+
+	// Check the value rather than the length, since a padded varint can be
+	// longer than the uint it holds
+	if v.Elem().OverflowUint(val) {
+		uintLen := int(v.Elem().Type().Size())
+		panic(fmt.Errorf("Uint too small to fit varint: %d bytes < %x", uintLen, val))
 	}
 
 	v.Elem().SetUint(val)
@@ -187,6 +507,72 @@ func varintDecoder(d *decodeState, v reflect.Value, opts fieldOptions) int {
 	return l
 }
 
+func intDecoder(d *decodeState, v reflect.Value, opts fieldOptions) int {
+	if opts.varint {
+		return signedVarintDecoder(d, v, opts)
+	}
+
+	intLen := int(v.Elem().Type().Size())
+	buf := d.Next(intLen)
+	if len(buf) != intLen {
+		panic(fmt.Errorf("Insufficient data to read int"))
+	}
+
+	v.Elem().SetInt(signExtend(decodeUintWithOrder(buf, opts.byteOrder(d.opts.ByteOrder)), 8*intLen))
+	return intLen
+}
+
+func signedVarintDecoder(d *decodeState, v reflect.Value, opts fieldOptions) int {
+	l, u := readVarint(d)
+	val := signExtend(u, 8*l-2)
+
+	switch {
+	case opts.varintPad > 0 && l != opts.varintPad:
+		panic(fmt.Errorf("Padded varint has wrong length: %d != %d", l, opts.varintPad))
+	case opts.varintPad == 0:
+		if minimal := signedVarintLength(val); l != minimal {
+			d.nonCanonical(d.offset()-l, "%d-byte varint for value with %d-byte encoding", l, minimal)
+		}
+	}
+
+	if v.Elem().OverflowInt(val) {
+		intLen := int(v.Elem().Type().Size())
+		panic(fmt.Errorf("Int too small to fit varint: %d bytes < %d", intLen, val))
+	}
+
+	v.Elem().SetInt(val)
+	return l
+}
+
+// signExtend interprets the low `bits` bits of u as a two's-complement value
+func signExtend(u uint64, bits int) int64 {
+	shift := uint(64 - bits)
+	return int64(u<<shift) >> shift
+}
+
+func boolDecoder(d *decodeState, v reflect.Value, opts fieldOptions) int {
+	size := opts.fixedSize
+	if size == 0 {
+		size = 1
+	}
+
+	buf := d.Next(size)
+	if len(buf) != size {
+		panic(fmt.Errorf("Insufficient data to read bool"))
+	}
+
+	switch val := decodeUintWithOrder(buf, opts.byteOrder(d.opts.ByteOrder)); val {
+	case 0:
+		v.Elem().SetBool(false)
+	case 1:
+		v.Elem().SetBool(true)
+	default:
+		panic(fmt.Errorf("Invalid value for bool: %#x", val))
+	}
+
+	return size
+}
+
 func readVarint(d *decodeState) (int, uint64) {
 	// Read the first octet and decide the size of the presented varint
 	first := d.Next(1)
@@ -208,6 +594,12 @@ func readVarint(d *decodeState) (int, uint64) {
 	return len(buf), decodeUintFromBuffer(buf)
 }
 
+func checkMinimalVarint(d *decodeState, l int, val uint64) {
+	if minimal := varintLength(val); l != minimal {
+		d.nonCanonical(d.offset()-l, "%d-byte varint for value with %d-byte encoding", l, minimal)
+	}
+}
+
 func decodeUintFromBuffer(buf []byte) uint64 {
 	val := uint64(0)
 	for _, b := range buf {
@@ -217,31 +609,95 @@ func decodeUintFromBuffer(buf []byte) uint64 {
 	return val
 }
 
-func setUintFromBuffer(v reflect.Value, buf []byte) int {
-	v.Elem().SetUint(decodeUintFromBuffer(buf))
-	return len(buf)
+func decodeUintWithOrder(buf []byte, order ByteOrder) uint64 {
+	if order == BigEndian {
+		return decodeUintFromBuffer(buf)
+	}
+
+	val := uint64(0)
+	for i := len(buf) - 1; i >= 0; i -= 1 {
+		val = (val << 8) + uint64(buf[i])
+	}
+	return val
 }
 
 //////////
 
 type arrayDecoder struct {
 	elemDec decoderFunc
+
+	// Whether the elements have their own encoding in both directions, so
+	// that the number of bytes each UnmarshalTLS call reports it consumed
+	// can be checked against the element's re-encoding
+	checkConsumed bool
 }
 
 func (ad *arrayDecoder) decode(d *decodeState, v reflect.Value, opts fieldOptions) int {
 	n := v.Elem().Type().Len()
 	read := 0
 	for i := 0; i < n; i += 1 {
-		read += ad.elemDec(d, v.Elem().Index(i).Addr(), opts)
+		elemRead := decodeElement(d, ad.elemDec, v.Elem().Index(i).Addr(), opts, i)
+		if ad.checkConsumed {
+			checkElementConsumed(v.Elem().Index(i), elemRead, i)
+		}
+		read += elemRead
 	}
 	return read
 }
 
+// checkElementConsumed verifies that the UnmarshalTLS method of an array
+// element consumed exactly as many bytes as the element encodes to, so that
+// a miscount cannot shift the elements that follow while staying within the
+// data.  Elements that cannot be re-encoded are not checked.
+func checkElementConsumed(v reflect.Value, read, i int) {
+	defer annotateElementError(i)
+
+	b, err := v.Interface().(Marshaler).MarshalTLS()
+	if err != nil {
+		return
+	}
+
+	if len(b) != read {
+		panic(fmt.Errorf("Invalid return value from UnmarshalTLS: consumed %d bytes, but the value encodes to %d", read, len(b)))
+	}
+}
+
+// decodeElement decodes element i of a vector, annotating any error with
+// the index of the element.  Since each element is validated as soon as it
+// is decoded, decoding stops at the first invalid element.
+func decodeElement(d *decodeState, dec decoderFunc, v reflect.Value, opts fieldOptions, i int) int {
+	defer annotateElementError(i)
+	return dec(d, v, opts)
+}
+
 func newArrayDecoder(t reflect.Type) decoderFunc {
-	dec := &arrayDecoder{typeDecoder(t.Elem())}
+	elem := t.Elem()
+	dec := &arrayDecoder{
+		elemDec:       typeDecoder(elem),
+		checkConsumed: elem.Implements(marshalerType) && reflect.PtrTo(elem).Implements(unmarshalerType),
+	}
 	return dec.decode
 }
 
+func bitsDecoder(d *decodeState, v reflect.Value, opts fieldOptions) int {
+	n := v.Elem().Len()
+	size := (n + 7) / 8
+	buf := d.Next(size)
+	if len(buf) != size {
+		panic(fmt.Errorf("Insufficient data to read bits"))
+	}
+
+	for i := 0; i < n; i += 1 {
+		v.Elem().Index(i).SetBool(buf[i/8]&(0x80>>uint(i%8)) != 0)
+	}
+
+	if pad := uint(8*size - n); pad > 0 && buf[size-1]&(1<<pad-1) != 0 {
+		d.nonCanonical(d.offset()-1, "Non-zero padding bits")
+	}
+
+	return size
+}
+
 //////////
 
 func decodeLength(d *decodeState, opts fieldOptions) (int, int) {
@@ -252,9 +708,14 @@ func decodeLength(d *decodeState, opts fieldOptions) (int, int) {
 		read = 0
 		length = d.Len()
 
+	case opts.fixedLength > 0:
+		read = 0
+		length = opts.fixedLength
+
 	case opts.varintHeader:
 		var length64 uint64
 		read, length64 = readVarint(d)
+		checkMinimalVarint(d, read, length64)
 		length = int(length64)
 
 	case opts.headerSize > 0:
@@ -263,18 +724,27 @@ func decodeLength(d *decodeState, opts fieldOptions) (int, int) {
 			panic(fmt.Errorf("Not enough data to read header"))
 		}
 		read = len(lengthBytes)
-		length = int(decodeUintFromBuffer(lengthBytes))
+		length64 := decodeUintWithOrder(lengthBytes, opts.byteOrder(d.opts.ByteOrder))
+		length = int(length64)
+		if length < 0 || uint64(length) != length64 {
+			panic(fmt.Errorf("Vector length too large [%d]", length64))
+		}
 
 	default:
 		panic(fmt.Errorf("Cannot decode a slice without a header length"))
 	}
 
+	length -= opts.lengthBias
+	if length < 0 {
+		panic(fmt.Errorf("Biased length is negative [%d]", length))
+	}
+
 	// Check that the length is OK
 	if opts.maxSize > 0 && length > opts.maxSize {
-		panic(fmt.Errorf("Length of vector exceeds declared max"))
+		panic(fmt.Errorf("Length of vector exceeds declared max [%d > %d]", length, opts.maxSize))
 	}
 	if length < opts.minSize {
-		panic(fmt.Errorf("Length of vector below declared min"))
+		panic(fmt.Errorf("Length of vector below declared min [%d < %d]", length, opts.minSize))
 	}
 
 	return read, length
@@ -282,12 +752,46 @@ func decodeLength(d *decodeState, opts fieldOptions) (int, int) {
 
 //////////
 
+func stringDecoder(d *decodeState, v reflect.Value, opts fieldOptions) int {
+	read, length := 0, opts.fixedSize
+	if !opts.cstring {
+		read, length = decodeLength(d, opts)
+	}
+
+	data := d.Next(length)
+	if len(data) != length {
+		panic(fmt.Errorf("Not enough data to read string"))
+	}
+
+	if opts.cstring {
+		if end := bytes.IndexByte(data, 0); end >= 0 {
+			if len(bytes.Trim(data[end:], "\x00")) > 0 {
+				d.nonCanonical(d.offset()-length+end, "Non-zero bytes after C string terminator")
+			}
+			data = data[:end]
+		}
+	}
+
+	if opts.charset != "" {
+		checkCharset(string(data), opts.charset)
+	}
+
+	d.allocate(len(data))
+	v.Elem().SetString(string(data))
+	return read + length
+}
+
+//////////
+
 type sliceDecoder struct {
 	elementType reflect.Type
 	elementDec  decoderFunc
 }
 
 func (sd *sliceDecoder) decode(d *decodeState, v reflect.Value, opts fieldOptions) int {
+	d.enter()
+	defer d.leave()
+
 	// Determine the length of the vector
 	read, length := decodeLength(d, opts)
 
@@ -298,21 +802,40 @@ func (sd *sliceDecoder) decode(d *decodeState, v reflect.Value, opts fieldOption
 	}
 
 	// For opaque values, we can return a reference instead of making a new slice
-	if v.Elem().Type().Elem() == uint8Type {
-		v.Elem().Set(reflect.ValueOf(elemData))
+	if v.Elem().Type().Elem() == uint8Type && opts.sparseLen == 0 {
+		if opts.encoding != "" {
+			elemData = textDecode(elemData, opts.encoding)
+		}
+
+		checkCount(len(elemData), opts)
+		d.allocate(len(elemData))
+		data := d.allocBytes(elemData)
+		if opts.fixedLength > 0 && d.opts.Alloc == nil {
+			// Fixed-length values such as hashes and nonces are often
+			// retained, so they do not refer to the input buffer
+			data = append([]byte(nil), data...)
+		}
+		v.Elem().Set(reflect.ValueOf(data))
 		return read + length
 	}
 
 	// For other values, we need to decode the raw data
-	elemBuf := &decodeState{}
-	elemBuf.Write(elemData)
+	elemBuf := d.sub(elemData)
+	if opts.sparseLen > 0 {
+		return read + sd.decodeSparse(elemBuf, v, opts)
+	}
+
+	elemRead := 0
 	elems := []reflect.Value{}
 	for elemBuf.Len() > 0 {
 		elem := reflect.New(sd.elementType)
-		read += sd.elementDec(elemBuf, elem, opts)
+		elemRead += decodeElement(elemBuf, sd.elementDec, elem, opts, len(elems))
 		elems = append(elems, elem)
 	}
+	checkCount(len(elems), opts)
+	read += elemRead
 
+	d.allocate(len(elems) * int(sd.elementType.Size()))
 	v.Elem().Set(reflect.MakeSlice(v.Elem().Type(), len(elems), len(elems)))
 	for i := 0; i < len(elems); i += 1 {
 		v.Elem().Index(i).Set(elems[i].Elem())
@@ -320,6 +843,55 @@ func (sd *sliceDecoder) decode(d *decodeState, v reflect.Value, opts fieldOption
 	return read
 }
 
+// decodeSparse decodes a sequence of (uint16 index, value) pairs into a
+// dense vector, leaving the elements that are not present as zero values
+func (sd *sliceDecoder) decodeSparse(d *decodeState, v reflect.Value, opts fieldOptions) int {
+	d.allocate(opts.sparseLen * int(sd.elementType.Size()))
+	dense := reflect.MakeSlice(v.Elem().Type(), opts.sparseLen, opts.sparseLen)
+
+	read := 0
+	next := 0
+	for d.Len() > 0 {
+		indexBytes := d.Next(sparseIndexSize)
+		if len(indexBytes) != sparseIndexSize {
+			panic(fmt.Errorf("Insufficient data to read sparse vector index"))
+		}
+		read += sparseIndexSize
+
+		index := int(decodeUintWithOrder(indexBytes, opts.byteOrder(d.opts.ByteOrder)))
+		switch {
+		case index >= opts.sparseLen:
+			panic(fmt.Errorf("Sparse vector index out of range [%d >= %d]", index, opts.sparseLen))
+		case index < next:
+			panic(fmt.Errorf("Sparse vector index out of order [%d < %d]", index, next))
+		}
+		next = index + 1
+
+		read += decodeElement(d, sd.elementDec, dense.Index(index).Addr(), opts, index)
+	}
+
+	v.Elem().Set(dense)
+	return read
+}
+
+func textDecode(data []byte, encoding string) []byte {
+	var decoded []byte
+	var err error
+	switch encoding {
+	case encodingBase64:
+		decoded, err = base64.StdEncoding.Strict().DecodeString(string(data))
+	case encodingHex:
+		decoded, err = hex.DecodeString(string(data))
+	default:
+		err = fmt.Errorf("Unknown encoding: %s", encoding)
+	}
+
+	if err != nil {
+		panic(fmt.Errorf("Invalid %s data: %v", encoding, err))
+	}
+	return decoded
+}
+
 func newSliceDecoder(t reflect.Type) decoderFunc {
 	dec := &sliceDecoder{
 		elementType: t.Elem(),
@@ -330,6 +902,38 @@ func newSliceDecoder(t reflect.Type) decoderFunc {
 
 //////////
 
+// appenderDecoder decodes a vector into a type that accumulates its own
+// elements, decoding each element into a value from NewElementTLS and
+// passing it to AppendTLS
+func appenderDecoder(d *decodeState, v reflect.Value, opts fieldOptions) int {
+	a, ok := v.Interface().(Appender)
+	if !ok {
+		panic(fmt.Errorf("Non-Appender passed to appenderDecoder"))
+	}
+
+	read, length := decodeLength(d, opts)
+	elemData := d.Next(length)
+	if len(elemData) != length {
+		panic(fmt.Errorf("Not enough data to read elements"))
+	}
+
+	elemBuf := d.sub(elemData)
+	elemRead := 0
+	for i := 0; elemBuf.Len() > 0; i += 1 {
+		elem := reflect.ValueOf(a.NewElementTLS())
+		if elem.Kind() != reflect.Ptr || elem.IsNil() {
+			panic(fmt.Errorf("NewElementTLS must return a non-nil pointer"))
+		}
+
+		elemRead += decodeElement(elemBuf, typeDecoder(elem.Type().Elem()), elem, opts, i)
+		a.AppendTLS(elem.Elem().Interface())
+	}
+
+	return read + elemRead
+}
+
+//////////
+
 type mapDecoder struct {
 	keyType reflect.Type
 	valType reflect.Type
@@ -338,6 +942,9 @@ type mapDecoder struct {
 }
 
 func (md mapDecoder) decode(d *decodeState, v reflect.Value, opts fieldOptions) int {
+	d.enter()
+	defer d.leave()
+
 	// Determine the length of the data
 	read, length := decodeLength(d, opts)
 
@@ -350,20 +957,50 @@ func (md mapDecoder) decode(d *decodeState, v reflect.Value, opts fieldOptions)
 	mapType := reflect.MapOf(md.keyType, md.valType)
 	v.Elem().Set(reflect.MakeMap(mapType))
 
-	nullOpts := fieldOptions{}
-	elemBuf := &decodeState{}
-	elemBuf.Write(elemData)
+	elemBuf := d.sub(elemData)
+	elemRead := 0
+	var last mapKey
 	for elemBuf.Len() > 0 {
-		key := reflect.New(md.keyType)
-		read += md.keyDec(elemBuf, key, nullOpts)
+		key, valRead := md.decodeEntry(elemBuf, v, elemData[elemRead:], last, opts, v.Elem().Len())
+		last = key
+		elemRead += len(key.enc) + valRead
+	}
+	checkCount(v.Elem().Len(), opts)
+
+	return read + elemRead
+}
+
+// mapKey is a decoded map key, along with its encoding
+type mapKey struct {
+	val reflect.Value
+	enc []byte
+}
 
-		val := reflect.New(md.valType)
-		read += md.valDec(elemBuf, val, nullOpts)
+// decodeEntry decodes entry i of a map from the front of d, where `data`
+// starts with the encoding of the entry, annotating any error with the
+// position of the entry.  It returns the key and the number of bytes read
+// for the value.
+func (md mapDecoder) decodeEntry(d *decodeState, v reflect.Value, data []byte, last mapKey, opts fieldOptions, i int) (mapKey, int) {
+	defer annotateElementError(i)
 
-		v.Elem().SetMapIndex(key.Elem(), val.Elem())
+	// Keys must be unique and sorted in the order the field specifies
+	nullOpts := fieldOptions{}
+	key := reflect.New(md.keyType)
+	keyRead := md.keyDec(d, key, nullOpts)
+	curr := mapKey{key.Elem(), data[:keyRead]}
+	switch {
+	case v.Elem().MapIndex(curr.val).IsValid():
+		d.nonCanonical(d.offset()-keyRead, "Duplicate map key")
+	case last.enc != nil && compareKeys(last.val, curr.val, last.enc, curr.enc, opts.numericKeys) >= 0:
+		d.nonCanonical(d.offset()-keyRead, "Map keys out of order")
 	}
 
-	return read
+	val := reflect.New(md.valType)
+	valRead := md.valDec(d, val, nullOpts)
+
+	d.allocate(int(md.keyType.Size() + md.valType.Size()))
+	v.Elem().SetMapIndex(curr.val, val.Elem())
+	return curr, valRead
 }
 
 func newMapDecoder(t reflect.Type) decoderFunc {
@@ -380,23 +1017,138 @@ func newMapDecoder(t reflect.Type) decoderFunc {
 //////////
 
 type structDecoder struct {
-	fieldOpts []fieldOptions
-	fieldDecs []decoderFunc
+	fieldNames []string
+	fieldOpts  []fieldOptions
+	fieldDecs  []decoderFunc
+	selectors  []int
+
+	// Fields covered by each checksum field
+	checksums   []*checksumRange
+	hasChecksum bool
+
+	// Index of the flags field for each flag-gated field
+	presence []int
+
+	// Index of the length field for each vector that takes its length from
+	// another field, and of the width field for each vector that takes its
+	// header width from another field
+	lengths []int
+	widths  []int
 }
 
 func (sd *structDecoder) decode(d *decodeState, v reflect.Value, opts fieldOptions) int {
+	d.enter()
+	defer d.leave()
+
+	// The encodings of the fields are only retained if a checksum needs them
+	var fieldData [][]byte
+	if sd.hasChecksum {
+		fieldData = make([][]byte, len(sd.fieldDecs))
+	}
+
 	read := 0
+	groups := []*decodeState{d}
 	for i := range sd.fieldDecs {
-		read += sd.fieldDecs[i](d, v.Elem().Field(i).Addr(), sd.fieldOpts[i])
+		cur := groups[len(groups)-1]
+		switch {
+		case sd.fieldOpts[i].groupHeaderSize > 0:
+			headerRead, group := readGroup(cur, sd.fieldOpts[i])
+			read += headerRead
+			groups = append(groups, group)
+			continue
+
+		case sd.fieldOpts[i].groupEnd:
+			checkGroupEnd(cur)
+			groups = groups[:len(groups)-1]
+			continue
+		}
+
+		data := cur.Bytes()
+		fieldRead := sd.decodeField(cur, v, i)
+		read += fieldRead
+
+		if fieldData != nil {
+			fieldData[i] = data[:fieldRead]
+		}
+
+		if sd.checksums[i] != nil {
+			expected := sd.checksums[i].sum(fieldData)
+			if actual := v.Elem().Field(i).Uint(); actual != expected {
+				panic(withPath(sd.fieldNames[i], fmt.Errorf("Checksum mismatch [%08x != %08x]", actual, expected)))
+			}
+		}
+	}
+
+	for i := len(groups) - 1; i > 0; i -= 1 {
+		checkGroupEnd(groups[i])
 	}
 	return read
 }
 
+func (sd *structDecoder) decodeField(d *decodeState, v reflect.Value, i int) int {
+	defer annotateFieldError(sd.fieldNames[i])
+
+	if sd.presence[i] >= 0 && !presenceBitSet(v.Elem().Field(sd.presence[i]), sd.fieldOpts[i]) {
+		field := v.Elem().Field(i)
+		field.Set(reflect.Zero(field.Type()))
+		return 0
+	}
+
+	if sd.lengths[i] >= 0 {
+		return lengthFromDecoder(d, v.Elem().Field(i).Addr(), v.Elem().Field(sd.lengths[i]), sd.fieldDecs[i], sd.fieldOpts[i])
+	}
+
+	if sd.widths[i] >= 0 {
+		return widthFromDecoder(d, v.Elem().Field(i).Addr(), v.Elem().Field(sd.widths[i]), sd.fieldDecs[i], sd.fieldOpts[i])
+	}
+
+	if sd.selectors[i] >= 0 {
+		return variantDecoder(d, v.Elem().Field(i), v.Elem().Field(sd.selectors[i]), sd.fieldOpts[i])
+	}
+
+	return sd.fieldDecs[i](d, v.Elem().Field(i).Addr(), sd.fieldOpts[i])
+}
+
+// readGroup reads the length header for a group of fields, and returns a
+// decodeState bounded to the fields in the group
+func readGroup(d *decodeState, opts fieldOptions) (int, *decodeState) {
+	headerSize := opts.groupHeaderSize
+	lengthBytes := d.Next(headerSize)
+	if len(lengthBytes) != headerSize {
+		panic(fmt.Errorf("Not enough data to read group header"))
+	}
+
+	length64 := decodeUintWithOrder(lengthBytes, opts.byteOrder(d.opts.ByteOrder))
+	length := int(length64)
+	if length < 0 || uint64(length) != length64 {
+		panic(fmt.Errorf("Group length too large [%d]", length64))
+	}
+
+	groupData := d.Next(length)
+	if len(groupData) != length {
+		panic(fmt.Errorf("Not enough data to read group"))
+	}
+
+	return headerSize, d.sub(groupData)
+}
+
+func checkGroupEnd(group *decodeState) {
+	if group.Len() > 0 {
+		panic(fmt.Errorf("Group length exceeds its fields by %d bytes", group.Len()))
+	}
+}
+
 func newStructDecoder(t reflect.Type) decoderFunc {
 	n := t.NumField()
 	sd := structDecoder{
-		fieldOpts: make([]fieldOptions, n),
-		fieldDecs: make([]decoderFunc, n),
+		fieldNames: make([]string, n),
+		fieldOpts:  make([]fieldOptions, n),
+		fieldDecs:  make([]decoderFunc, n),
+		selectors:  make([]int, n),
+		checksums:  make([]*checksumRange, n),
+		presence:   make([]int, n),
+		lengths:    make([]int, n),
+		widths:     make([]int, n),
 	}
 
 	for i := 0; i < n; i += 1 {
@@ -409,17 +1161,66 @@ func newStructDecoder(t reflect.Type) decoderFunc {
 			panic(fmt.Errorf("Tags invalid for field type"))
 		}
 
+		sd.fieldNames[i] = f.Name
 		sd.fieldOpts[i] = opts
-		if sd.fieldOpts[i].omit {
+		sd.selectors[i] = selectorIndex(t, i, opts)
+		sd.checksums[i] = checksumFields(t, i, opts)
+		if sd.checksums[i] != nil {
+			sd.hasChecksum = true
+		}
+		sd.presence[i] = presenceIndex(t, i, opts)
+		sd.lengths[i] = lengthFromIndex(t, i, opts)
+		if sd.lengths[i] >= 0 {
+			// The vector itself is decoded without a header
+			opts.omitHeader = true
+			sd.fieldOpts[i] = opts
+		}
+		sd.widths[i] = widthFromIndex(t, i, opts)
+
+		if opts.omit || opts.groupHeaderSize > 0 || opts.groupEnd {
 			sd.fieldDecs[i] = omitDecoder
+		} else if sd.selectors[i] >= 0 {
+			sd.fieldDecs[i] = nil
+		} else if opts.bits {
+			sd.fieldDecs[i] = bitsDecoder
+		} else if isFramed(f.Type, opts) {
+			sd.fieldDecs[i] = newFramedDecoder(f.Type)
 		} else {
 			sd.fieldDecs[i] = typeDecoder(f.Type)
 		}
 	}
 
+	if !groupsBalanced(sd.fieldOpts) {
+		panic(fmt.Errorf("Group end without matching group start"))
+	}
+
 	return sd.decode
 }
 
+// newFramedDecoder returns a decoder for a field of a FramedMarshaler type
+// with a length header.  The value must consume all of the data that the
+// header delimits, unless the Resync option is set.
+func newFramedDecoder(t reflect.Type) decoderFunc {
+	return func(d *decodeState, v reflect.Value, opts fieldOptions) int {
+		headRead, length := decodeLength(d, opts)
+		start := d.offset()
+		data := d.Next(length)
+		if len(data) != length {
+			panic(fmt.Errorf("Not enough data to read framed value"))
+		}
+
+		read := typeDecoder(t)(d.sub(data), v, fieldOptions{})
+		if read != length {
+			if !d.opts.Resync {
+				panic(fmt.Errorf("Framed value not fully consumed [%d < %d]", read, length))
+			}
+
+			d.warn(start+read, fmt.Sprintf("Framed value not fully consumed [%d < %d]; resuming after frame", read, length))
+		}
+		return headRead + length
+	}
+}
+
 //////////
 
 type pointerDecoder struct {
@@ -428,27 +1229,67 @@ type pointerDecoder struct {
 
 func (pd *pointerDecoder) decode(d *decodeState, v reflect.Value, opts fieldOptions) int {
 	readBase := 0
-	if opts.optional {
-		readBase = 1
-		flag := d.Next(1)
-		switch flag[0] {
-		case optionalFlagAbsent:
+	if opts.absent != nil {
+		size := int(v.Elem().Type().Elem().Size())
+		data := d.peek(size)
+		if data == nil {
+			panic(fmt.Errorf("Insufficient data to read optional"))
+		}
+
+		if decodeUintWithOrder(data, opts.byteOrder(d.opts.ByteOrder)) == *opts.absent {
+			d.Next(size)
 			indir := v.Elem()
 			indir.Set(reflect.Zero(indir.Type()))
-			return 1
-
-		case optionalFlagPresent:
-			// No action; continue as normal
-
-		default:
-			panic(fmt.Errorf("Invalid flag byte for optional: [%x]", flag))
+			return size
+		}
+	} else if opts.optional {
+		var present bool
+		present, readBase = readPresence(d, opts)
+		if !present {
+			indir := v.Elem()
+			indir.Set(reflect.Zero(indir.Type()))
+			return readBase
 		}
 	}
 
-	v.Elem().Set(reflect.New(v.Elem().Type().Elem()))
+	// As with encoding/json, decode into the value the pointer already points
+	// to, and only allocate a new value if the pointer is nil
+	if v.Elem().IsNil() {
+		v.Elem().Set(reflect.New(v.Elem().Type().Elem()))
+	}
 	return readBase + pd.base(d, v.Elem(), opts)
 }
 
+// readPresence reads the presence field of an optional, returning whether
+// the value is present and the number of bytes read.  In a wide presence
+// field, only the low octet is meaningful; non-zero high octets are
+// non-canonical.
+func readPresence(d *decodeState, opts fieldOptions) (bool, int) {
+	size := opts.presenceSize
+	if size == 0 {
+		size = 1
+	}
+
+	data := d.Next(size)
+	if len(data) != size {
+		panic(fmt.Errorf("Insufficient data to read presence octet for optional"))
+	}
+
+	val := decodeUintWithOrder(data, opts.byteOrder(d.opts.ByteOrder))
+	if val>>8 != 0 {
+		d.nonCanonical(d.offset()-size, "Non-zero high octets in presence field: %#x", val)
+	}
+
+	switch uint8(val) {
+	case optionalFlagAbsent:
+		return false, size
+	case optionalFlagPresent:
+		return true, size
+	default:
+		panic(fmt.Errorf("Invalid presence octet for optional: %#02x", uint8(val)))
+	}
+}
+
 func newPointerDecoder(t reflect.Type) decoderFunc {
 	baseDecoder := typeDecoder(t.Elem())
 	pd := pointerDecoder{base: baseDecoder}
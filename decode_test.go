@@ -1,7 +1,9 @@
 package syntax
 
 import (
+	"errors"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -31,6 +33,20 @@ func TestDecodeErrors(t *testing.T) {
 			encoding: buffer(0),
 		},
 
+		"optional-sentinel-short": {
+			template: struct {
+				V *uint16 `tls:"optional,absent=0xFFFF"`
+			}{},
+			encoding: unhex("FF"),
+		},
+
+		"bias-negative": {
+			template: struct {
+				V []byte `tls:"head=1,bias=1"`
+			}{},
+			encoding: unhex("00"),
+		},
+
 		"uint-too-small": {
 			template: uint32(0),
 			encoding: unhex("7fff"),
@@ -43,6 +59,51 @@ func TestDecodeErrors(t *testing.T) {
 			encoding: unhex("7fff"),
 		},
 
+		"bool-invalid": {
+			template: false,
+			encoding: unhex("02"),
+		},
+
+		"bool-wide-high-octet": {
+			template: struct {
+				V bool `tls:"size=2"`
+			}{},
+			encoding: unhex("0101"),
+		},
+
+		"bool-short": {
+			template: struct {
+				V bool `tls:"size=4"`
+			}{},
+			encoding: unhex("000001"),
+		},
+
+		"varint-signed-too-big": {
+			template: struct {
+				V int8 `tls:"varint"`
+			}{},
+			encoding: unhex("BFFF8000"),
+		},
+
+		"int-too-small": {
+			template: int32(0),
+			encoding: unhex("FFFF"),
+		},
+
+		"varint-pad-too-short": {
+			template: struct {
+				V uint16 `tls:"varint,pad=4"`
+			}{},
+			encoding: unhex("7fff"),
+		},
+
+		"varint-pad-too-long": {
+			template: struct {
+				V uint16 `tls:"varint,pad=2"`
+			}{},
+			encoding: unhex("80003fff"),
+		},
+
 		// Slice errors
 		"no-head": {
 			template: struct{ V []byte }{},
@@ -84,6 +145,20 @@ func TestDecodeErrors(t *testing.T) {
 			encoding: vector0x20[:2],
 		},
 
+		"head-8-too-large": {
+			template: struct {
+				V []byte `tls:"head=8"`
+			}{},
+			encoding: unhex("FFFFFFFFFFFFFFFF" + "A0A1"),
+		},
+
+		"too-short-for-fixed": {
+			template: struct {
+				V []byte `tls:"fixed=32"`
+			}{},
+			encoding: buffer(31),
+		},
+
 		"too-short-for-value": {
 			template: struct {
 				V []byte `tls:"head=3"`
@@ -126,6 +201,133 @@ func TestDecodeErrors(t *testing.T) {
 			encoding: unhex(""),
 		},
 
+		"slice-marshaler-overrun": {
+			template: struct {
+				V []CrypticString `tls:"head=1"`
+			}{},
+			encoding: unhex("03" + "056e62" + "646565"),
+		},
+
+		"base64-missing-padding": {
+			template: struct {
+				V []byte `tls:"head=1,encoding=base64"`
+			}{},
+			encoding: unhex("03" + "51513d"),
+		},
+
+		"base64-noncanonical-padding": {
+			template: struct {
+				V []byte `tls:"head=1,encoding=base64"`
+			}{},
+			encoding: unhex("04" + "51523d3d"),
+		},
+
+		"hex-odd-length": {
+			template: struct {
+				V []byte `tls:"head=1,encoding=hex"`
+			}{},
+			encoding: unhex("03" + "613061"),
+		},
+
+		"hex-invalid-character": {
+			template: struct {
+				V []byte `tls:"head=1,encoding=hex"`
+			}{},
+			encoding: unhex("02" + "7a7a"),
+		},
+
+		"invalid-encoding-tag": {
+			template: struct {
+				V [2]byte `tls:"encoding=hex"`
+			}{},
+			encoding: unhex(""),
+		},
+
+		// String errors
+		"string-too-short": {
+			template: struct {
+				V string `tls:"head=1"`
+			}{},
+			encoding: unhex("05" + "6869"),
+		},
+
+		"cstring-too-short": {
+			template: struct {
+				V string `tls:"size=4,cstring"`
+			}{},
+			encoding: unhex("6869"),
+		},
+
+		"invalid-cstring-tag": {
+			template: struct {
+				V string `tls:"head=1,size=4,cstring"`
+			}{},
+			encoding: unhex("00"),
+		},
+
+		// Sparse slice errors
+		"sparse-index-out-of-range": {
+			template: struct {
+				V []uint16 `tls:"head=1,sparse=2"`
+			}{},
+			encoding: unhex("04" + "0002A0A1"),
+		},
+
+		"sparse-index-duplicate": {
+			template: struct {
+				V []uint16 `tls:"head=1,sparse=2"`
+			}{},
+			encoding: unhex("08" + "0001A0A1" + "0001B0B1"),
+		},
+
+		"sparse-index-out-of-order": {
+			template: struct {
+				V []uint16 `tls:"head=1,sparse=2"`
+			}{},
+			encoding: unhex("08" + "0001A0A1" + "0000B0B1"),
+		},
+
+		"sparse-truncated-index": {
+			template: struct {
+				V []uint16 `tls:"head=1,sparse=2"`
+			}{},
+			encoding: unhex("01" + "00"),
+		},
+
+		// Group errors
+		"group-too-long": {
+			template: struct {
+				_ struct{} `tls:"group=1"`
+				A uint16
+				_ struct{} `tls:"group=end"`
+			}{},
+			encoding: unhex("03A0A1A2"),
+		},
+
+		"group-too-short": {
+			template: struct {
+				_ struct{} `tls:"group=1"`
+				A uint16
+			}{},
+			encoding: unhex("01A0A1"),
+		},
+
+		"group-length-overflow": {
+			template: struct {
+				_ struct{} `tls:"group=8"`
+				A uint16
+			}{},
+			encoding: unhex("FFFFFFFFFFFFFFFF" + "A0A1"),
+		},
+
+		"group-unbalanced": {
+			template: struct {
+				A uint16
+				_ struct{} `tls:"group=end"`
+			}{},
+			encoding: unhex("A0A1"),
+		},
+
 		// Optional errors
 		"invalid-optional-flag": {
 			template: struct {
@@ -134,6 +336,13 @@ func TestDecodeErrors(t *testing.T) {
 			encoding: unhex("0203"),
 		},
 
+		"missing-optional-flag": {
+			template: struct {
+				V *uint8 `tls:"optional"`
+			}{},
+			encoding: unhex(""),
+		},
+
 		// Validator errors
 		"invalid-validator": {
 			template: CrypticString(""),
@@ -148,3 +357,683 @@ func TestDecodeErrors(t *testing.T) {
 		require.Equal(t, read, 0, label)
 	}
 }
+
+// A trustingString has the same encoding as a CrypticString without the
+// XOR, but its UnmarshalTLS trusts the length octet without checking it
+// against the data it was given.
+type trustingString string
+
+func (ts *trustingString) UnmarshalTLS(data []byte) (int, error) {
+	l := int(data[0])
+	if len(data) >= l+1 {
+		*ts = trustingString(data[1 : l+1])
+	}
+	return l + 1, nil
+}
+
+func TestDecodeVectorOverrun(t *testing.T) {
+	// The second element claims four bytes, but only two remain in the vector
+	encoding := unhex("05" + "01A0" + "04B0B1" + "C0C1")
+
+	var decoded struct {
+		V []trustingString `tls:"head=1"`
+		W uint16
+	}
+	_, err := Unmarshal(encoding, &decoded)
+	require.NotNil(t, err)
+	require.True(t, strings.Contains(err.Error(), "V[1]"), err.Error())
+	require.True(t, strings.Contains(err.Error(), "consumed 5 bytes of 3"), err.Error())
+}
+
+// A greedyOctet holds one octet, but its UnmarshalTLS reports that it
+// consumed two.
+type greedyOctet uint8
+
+func (g *greedyOctet) UnmarshalTLS(data []byte) (int, error) {
+	if len(data) > 0 {
+		*g = greedyOctet(data[0])
+	}
+	return 2, nil
+}
+
+func TestDecodeArrayMiscount(t *testing.T) {
+	// The data holds four elements, but the miscounting elements exhaust it
+	// after two, so the third element's UnmarshalTLS overruns the data, and
+	// the error identifies that element
+	encoding := unhex("A0A1A2A3")
+
+	var decoded [4]greedyOctet
+	_, err := Unmarshal(encoding, &decoded)
+	require.NotNil(t, err)
+	require.True(t, strings.Contains(err.Error(), "field [2]:"), err.Error())
+	require.True(t, strings.Contains(err.Error(), "consumed 2 bytes of 0"), err.Error())
+}
+
+// A stingyPair holds two octets, but its UnmarshalTLS reports that it
+// consumed one.
+type stingyPair [2]byte
+
+func (sp stingyPair) MarshalTLS() ([]byte, error) {
+	return sp[:], nil
+}
+
+func (sp *stingyPair) UnmarshalTLS(data []byte) (int, error) {
+	if len(data) < 2 {
+		return 0, errors.New("stingyPair too short")
+	}
+	copy(sp[:], data)
+	return 1, nil
+}
+
+func TestDecodeArrayUndercount(t *testing.T) {
+	// The miscounting elements overlap, and stay within the data, so only
+	// comparing each element's consumption to its encoding detects them
+	encoding := unhex("A0A1A2A3")
+
+	var decoded [2]stingyPair
+	_, err := Unmarshal(encoding, &decoded)
+	require.NotNil(t, err)
+	require.True(t, strings.Contains(err.Error(), "field [0]:"), err.Error())
+	require.True(t, strings.Contains(err.Error(), "consumed 1 bytes, but the value encodes to 2"), err.Error())
+}
+
+// A shortBlob holds an arbitrary byte string, but its UnmarshalTLS reports
+// that it consumed one byte less than it was given.
+type shortBlob []byte
+
+func (sb shortBlob) MarshalTLSFramed(f Framing) ([]byte, error) {
+	return sb, nil
+}
+
+func (sb *shortBlob) UnmarshalTLS(data []byte) (int, error) {
+	*sb = append(shortBlob{}, data...)
+	return len(data) - 1, nil
+}
+
+func TestDecodeResync(t *testing.T) {
+	type frames struct {
+		A shortBlob `tls:"head=1"`
+		B uint16
+	}
+	encoding := unhex("03" + "A0A1A2" + "B0B1")
+
+	// Without resync, the miscount is an error
+	var decoded frames
+	_, err := Unmarshal(encoding, &decoded)
+	require.NotNil(t, err)
+
+	// With resync, decoding continues after the frame
+	var warnings []Warning
+	read, err := UnmarshalWithOptions(encoding, &decoded, DecodeOptions{Resync: true, Warnings: &warnings})
+	require.Nil(t, err)
+	require.Equal(t, read, len(encoding))
+	require.Equal(t, decoded, frames{A: shortBlob{0xA0, 0xA1, 0xA2}, B: 0xB0B1})
+	require.Equal(t, len(warnings), 1)
+	require.Equal(t, warnings[0].Offset, 3)
+}
+
+func TestDecodeElementValidation(t *testing.T) {
+	// The element at index 2 is forbidden, and the element at index 3 is
+	// truncated.  Validation must stop decoding at index 2.
+	encoding := unhex("14" + "056e62646565" + "056e62646565" + "056069677b6e" + "056e")
+
+	var decoded struct {
+		V []CrypticString `tls:"head=1"`
+	}
+	read, err := Unmarshal(encoding, &decoded)
+	require.NotNil(t, err)
+	require.Equal(t, read, 0)
+	require.True(t, strings.Contains(err.Error(), "field V[2]:"), err.Error())
+	require.True(t, strings.Contains(err.Error(), "Forbidden value"), err.Error())
+
+	// With forbidden elements at indices 2 and 4, the lowest index is reported
+	encoding = unhex("1e" + "056e62646565" + "056e62646565" + "056069677b6e" + "056e62646565" + "056069677b6e")
+	_, err = Unmarshal(encoding, &decoded)
+	require.NotNil(t, err)
+	require.True(t, strings.Contains(err.Error(), "field V[2]:"), err.Error())
+}
+
+func TestDecodeWarnings(t *testing.T) {
+	type varintVector struct {
+		V []struct {
+			X uint16 `tls:"varint"`
+		} `tls:"head=1"`
+	}
+
+	cases := map[string]struct {
+		template interface{}
+		encoding []byte
+		offsets  []int
+	}{
+		"minimal": {
+			template: struct {
+				V uint16 `tls:"varint"`
+			}{},
+			encoding: unhex("01"),
+			offsets:  []int{},
+		},
+		"non-minimal": {
+			template: struct {
+				V uint16 `tls:"varint"`
+			}{},
+			encoding: unhex("4001"),
+			offsets:  []int{0},
+		},
+		"non-minimal-padded": {
+			template: struct {
+				V uint16 `tls:"varint,pad=2"`
+			}{},
+			encoding: unhex("4001"),
+			offsets:  []int{},
+		},
+		"non-minimal-head": {
+			template: struct {
+				V []byte `tls:"head=varint"`
+			}{},
+			encoding: unhex("4001A0"),
+			offsets:  []int{0},
+		},
+		"cstring-trailing-garbage": {
+			template: struct {
+				V string `tls:"size=4,cstring"`
+			}{},
+			encoding: unhex("68690078"),
+			offsets:  []int{2},
+		},
+		"bits-padding": {
+			template: struct {
+				V [10]bool `tls:"bits"`
+			}{},
+			encoding: unhex("C0C1"),
+			offsets:  []int{1},
+		},
+		"map-sorted": {
+			template: struct {
+				V map[ExtensionType]struct{} `tls:"head=1"`
+			}{},
+			encoding: unhex("06" + "0001" + "00FF" + "0102"),
+			offsets:  []int{},
+		},
+		"map-duplicate-key": {
+			template: struct {
+				V map[ExtensionType]struct{} `tls:"head=1"`
+			}{},
+			encoding: unhex("06" + "0001" + "00FF" + "0001"),
+			offsets:  []int{5},
+		},
+		"map-unsorted-keys": {
+			template: struct {
+				V map[ExtensionType]struct{} `tls:"head=1"`
+			}{},
+			encoding: unhex("06" + "0001" + "0102" + "00FF"),
+			offsets:  []int{5},
+		},
+		"non-minimal-signed-varint": {
+			template: struct {
+				V int16 `tls:"varint"`
+			}{},
+			encoding: unhex("7FFF"),
+			offsets:  []int{0},
+		},
+		"minimal-signed-varint": {
+			template: struct {
+				V int16 `tls:"varint"`
+			}{},
+			encoding: unhex("7FDF"),
+			offsets:  []int{},
+		},
+		"non-minimal-elements": {
+			template: varintVector{},
+			encoding: unhex("05" + "01" + "4002" + "4003"),
+			offsets:  []int{2, 4},
+		},
+	}
+
+	for label, testCase := range cases {
+		// Lenient mode succeeds, reporting the anomalies as warnings
+		warnings := []Warning{}
+		decodedPointer := reflect.New(reflect.TypeOf(testCase.template))
+		read, err := UnmarshalWithOptions(testCase.encoding, decodedPointer.Interface(),
+			DecodeOptions{Warnings: &warnings})
+		require.Nil(t, err, label)
+		require.Equal(t, read, len(testCase.encoding), label)
+
+		offsets := []int{}
+		for _, w := range warnings {
+			offsets = append(offsets, w.Offset)
+		}
+		require.Equal(t, offsets, testCase.offsets, label)
+
+		// Strict mode fails if there were any anomalies
+		_, err = UnmarshalWithOptions(testCase.encoding, decodedPointer.Interface(),
+			DecodeOptions{Strict: true})
+		require.Equal(t, err != nil, len(testCase.offsets) > 0, label)
+	}
+}
+
+func TestDecodeOptionalPresence(t *testing.T) {
+	var decoded struct {
+		Present *uint8 `tls:"optional"`
+	}
+
+	for _, flag := range []string{"00", "01"} {
+		_, err := Unmarshal(unhex(flag+"A0"), &decoded)
+		require.Nil(t, err)
+	}
+
+	for _, flag := range []string{"02", "80", "FF"} {
+		read, err := Unmarshal(unhex(flag+"A0"), &decoded)
+		require.NotNil(t, err)
+		require.Equal(t, read, 0)
+		require.True(t, strings.Contains(err.Error(), "Present"), err.Error())
+		require.True(t, strings.Contains(err.Error(), "0x"+strings.ToLower(flag)), err.Error())
+	}
+}
+
+func TestElementCount(t *testing.T) {
+	type counted struct {
+		A []uint16        `tls:"head=varint,mincount=1,maxcount=2"`
+		B map[uint8]uint8 `tls:"head=1,maxcount=1"`
+		C []byte          `tls:"head=none,mincount=2"`
+	}
+
+	value := counted{A: []uint16{0xA0A1, 0xA2A3}, B: map[uint8]uint8{0xB0: 0xB1}, C: []byte{0xC0, 0xC1}}
+	encoding := unhex("04" + "A0A1A2A3" + "02" + "B0B1" + "C0C1")
+
+	out, err := Marshal(value)
+	require.Nil(t, err)
+	require.Equal(t, out, encoding)
+
+	var decoded counted
+	read, err := Unmarshal(out, &decoded)
+	require.Nil(t, err)
+	require.Equal(t, read, len(out))
+	require.Equal(t, decoded, value)
+
+	// Bounds are checked on both encode and decode, and errors report the
+	// field name
+	cases := map[string]struct {
+		value    counted
+		encoding []byte
+		message  string
+	}{
+		"too-few": {
+			value:    counted{A: []uint16{}, C: []byte{0xC0, 0xC1}},
+			encoding: unhex("00" + "00" + "C0C1"),
+			message:  "syntax: field A: Element count less than min [0 < 1]",
+		},
+		"too-many": {
+			value:    counted{A: []uint16{1, 2, 3}, C: []byte{0xC0, 0xC1}},
+			encoding: unhex("06" + "000100020003" + "00" + "C0C1"),
+			message:  "syntax: field A: Element count more than max [3 > 2]",
+		},
+		"map-too-many": {
+			value:    counted{A: []uint16{1}, B: map[uint8]uint8{1: 1, 2: 2}, C: []byte{0xC0, 0xC1}},
+			encoding: unhex("02" + "0001" + "04" + "01010202" + "C0C1"),
+			message:  "syntax: field B: Element count more than max [2 > 1]",
+		},
+		"opaque-too-short": {
+			value:    counted{A: []uint16{1}, C: []byte{0xC0}},
+			encoding: unhex("02" + "0001" + "00" + "C0"),
+			message:  "syntax: field C: Element count less than min [1 < 2]",
+		},
+	}
+
+	for label, testCase := range cases {
+		_, err := Marshal(testCase.value)
+		require.NotNil(t, err, label)
+		require.Equal(t, err.Error(), testCase.message, label)
+
+		_, err = Unmarshal(testCase.encoding, &decoded)
+		require.NotNil(t, err, label)
+		require.Equal(t, err.Error(), testCase.message, label)
+	}
+}
+
+type nestedDepth struct {
+	Children []nestedDepth `tls:"head=varint"`
+}
+
+func TestDecodeLimits(t *testing.T) {
+	// Each level of nesting is a struct holding a vector
+	encoding := []byte{0x00}
+	for i := 0; i < 20; i += 1 {
+		encoding = append([]byte{byte(len(encoding))}, encoding...)
+	}
+
+	var nested nestedDepth
+	_, err := Unmarshal(encoding, &nested)
+	require.Nil(t, err)
+
+	_, err = UnmarshalWithOptions(encoding, &nested, DecodeOptions{MaxDepth: 10})
+	require.NotNil(t, err)
+	require.True(t, strings.Contains(err.Error(), "Nesting depth exceeds maximum"), err.Error())
+
+	// Decoding stops once the decoded size exceeds the maximum
+	var vector struct {
+		V []uint16 `tls:"head=2"`
+	}
+	encoding = append(unhex("00C8"), buffer(200)...)
+
+	_, err = UnmarshalWithOptions(encoding, &vector, DecodeOptions{MaxSize: 200})
+	require.Nil(t, err)
+
+	_, err = UnmarshalWithOptions(encoding, &vector, DecodeOptions{MaxSize: 199})
+	require.NotNil(t, err)
+	require.True(t, strings.Contains(err.Error(), "Decoded size exceeds maximum"), err.Error())
+}
+
+var errOddByte = errors.New("Odd value")
+
+type evenByte uint8
+
+func (b evenByte) ValidForTLS() error {
+	if b%2 != 0 {
+		return errOddByte
+	}
+	return nil
+}
+
+func TestDecodeValidation(t *testing.T) {
+	type inner struct {
+		Value evenByte
+	}
+
+	type outer struct {
+		Inner    inner
+		Optional *evenByte          `tls:"optional"`
+		Vector   []evenByte         `tls:"head=1"`
+		Map      map[uint8]evenByte `tls:"head=1"`
+	}
+
+	cases := map[string]struct {
+		encoding []byte
+		path     string
+	}{
+		"valid":    {unhex("00" + "0102" + "020204" + "020106"), ""},
+		"nested":   {unhex("01" + "0102" + "020204" + "020106"), "Inner.Value"},
+		"optional": {unhex("00" + "0103" + "020204" + "020106"), "Optional"},
+		"vector":   {unhex("00" + "0102" + "020205" + "020106"), "Vector[1]"},
+		"map":      {unhex("00" + "0102" + "020204" + "020107"), "Map[0]"},
+	}
+
+	for label, testCase := range cases {
+		var decoded outer
+		_, err := Unmarshal(testCase.encoding, &decoded)
+		if testCase.path == "" {
+			require.Nil(t, err, label)
+			continue
+		}
+
+		require.NotNil(t, err, label)
+		require.True(t, errors.Is(err, errOddByte), label)
+		require.Equal(t, err.(*SyntaxError).Path, testCase.path, label)
+	}
+}
+
+func TestDecodeFixedLength(t *testing.T) {
+	var decoded struct {
+		Nonce []byte `tls:"fixed=12"`
+		Rest  []byte `tls:"head=none"`
+	}
+
+	// The fixed-length field takes exactly its length, leaving the rest
+	encoding := unhex(hexBuffer(12) + "A0A1")
+	read, err := Unmarshal(encoding, &decoded)
+	require.Nil(t, err)
+	require.Equal(t, read, len(encoding))
+	require.Equal(t, decoded.Nonce, buffer(12))
+	require.Equal(t, decoded.Rest, unhex("A0A1"))
+
+	// The fixed-length field does not refer to the input
+	encoding[0] ^= 0xFF
+	require.Equal(t, decoded.Nonce, buffer(12))
+}
+
+func TestDecodeWidePresence(t *testing.T) {
+	var decoded struct {
+		Present *uint8 `tls:"optional,presence=2"`
+	}
+
+	// Canonical presence fields are accepted in strict mode
+	for _, flag := range []string{"0000", "0001"} {
+		_, err := UnmarshalWithOptions(unhex(flag+"A0"), &decoded, DecodeOptions{Strict: true})
+		require.Nil(t, err)
+	}
+
+	// Non-zero high octets are reported, or rejected in strict mode
+	for _, flag := range []string{"0100", "8001"} {
+		var warnings []Warning
+		_, err := UnmarshalWithOptions(unhex(flag+"A0"), &decoded, DecodeOptions{Warnings: &warnings})
+		require.Nil(t, err)
+		require.Equal(t, len(warnings), 1)
+
+		_, err = UnmarshalWithOptions(unhex(flag+"A0"), &decoded, DecodeOptions{Strict: true})
+		require.NotNil(t, err)
+	}
+
+	// An invalid low octet is always rejected
+	_, err := Unmarshal(unhex("0002A0"), &decoded)
+	require.NotNil(t, err)
+
+	// Presence fields are encoded canonically
+	encoding, err := Marshal(decoded)
+	require.Nil(t, err)
+	require.Equal(t, encoding, unhex("0001A0"))
+}
+
+func TestDecodeAllocated(t *testing.T) {
+	var decoded struct {
+		A []byte           `tls:"head=1"`
+		B []uint16         `tls:"head=1"`
+		C [][]uint32       `tls:"head=1"`
+		D map[uint8]uint16 `tls:"head=1"`
+	}
+	encoding := unhex("05" + "A0A1A2A3A4" +
+		"06" + "B0B1B2B3B4B5" +
+		"0A" + "04C0C1C2C3" + "04D0D1D2D3" +
+		"06" + "01E0E1" + "02F0F1")
+
+	allocated := 0
+	_, err := UnmarshalWithOptions(encoding, &decoded, DecodeOptions{Allocated: &allocated})
+	require.Nil(t, err)
+
+	expected := len(decoded.A) + 2*len(decoded.B) + 3*len(decoded.D)
+	expected += len(decoded.C) * int(reflect.TypeOf(decoded.C).Elem().Size())
+	for _, c := range decoded.C {
+		expected += 4 * len(c)
+	}
+	require.Equal(t, allocated, expected)
+}
+
+func TestDecodeAlloc(t *testing.T) {
+	var decoded struct {
+		A []byte   `tls:"head=1"`
+		B [][]byte `tls:"head=1"`
+		C Lazy     `tls:"head=1"`
+	}
+	encoding := unhex("03" + "A0A1A2" + "05" + "01B0" + "02C0C1" + "02D0D1")
+
+	// The arena hands out consecutive pieces of a single buffer
+	arena := make([]byte, 0, 64)
+	requested := 0
+	alloc := func(size int) []byte {
+		requested += size
+		arena = arena[:len(arena)+size]
+		return arena[len(arena)-size:]
+	}
+
+	read, err := UnmarshalWithOptions(encoding, &decoded, DecodeOptions{Alloc: alloc})
+	require.Nil(t, err)
+	require.Equal(t, read, len(encoding))
+	require.Equal(t, requested, 8)
+	require.Equal(t, arena, unhex("A0A1A2"+"B0"+"C0C1"+"D0D1"))
+
+	lazy, err := decoded.C.Bytes()
+	require.Nil(t, err)
+	require.Equal(t, lazy, unhex("D0D1"))
+
+	// An allocator that returns the wrong size is an error
+	_, err = UnmarshalWithOptions(encoding, &decoded, DecodeOptions{
+		Alloc: func(size int) []byte { return nil },
+	})
+	require.NotNil(t, err)
+}
+
+func TestDecodeReuse(t *testing.T) {
+	type inner struct {
+		A uint16
+		B []byte `tls:"head=1"`
+	}
+	type outer struct {
+		P *inner
+		V inner
+		Q *inner `tls:"optional"`
+	}
+
+	var decoded outer
+	_, err := Unmarshal(unhex("A0A1"+"01A2"+"B0B1"+"01B2"+"01"+"C0C1"+"01C2"), &decoded)
+	require.Nil(t, err)
+
+	p, v, q := decoded.P, &decoded.V, decoded.Q
+	_, err = Unmarshal(unhex("D0D1"+"00"+"E0E1"+"00"+"01"+"F0F1"+"00"), &decoded)
+	require.Nil(t, err)
+	require.True(t, decoded.P == p)
+	require.True(t, &decoded.V == v)
+	require.True(t, decoded.Q == q)
+	require.Equal(t, decoded.P.A, uint16(0xD0D1))
+	require.Equal(t, decoded.V.A, uint16(0xE0E1))
+	require.Equal(t, decoded.Q.A, uint16(0xF0F1))
+
+	// An absent optional value clears the pointer, and a present one
+	// allocates a new value
+	_, err = Unmarshal(unhex("D0D1"+"00"+"E0E1"+"00"+"00"), &decoded)
+	require.Nil(t, err)
+	require.Nil(t, decoded.Q)
+
+	_, err = Unmarshal(unhex("D0D1"+"00"+"E0E1"+"00"+"01"+"F0F1"+"00"), &decoded)
+	require.Nil(t, err)
+	require.NotNil(t, decoded.Q)
+	require.False(t, decoded.Q == q)
+}
+
+func TestUnmarshalSlice(t *testing.T) {
+	encoding := unhex("000a0005f0f1f2f3f4" + "000b0000" + "000c0001A0")
+	expected := []Extension{
+		extValidIn,
+		{ExtensionType: 0x000b, ExtensionData: []byte{}},
+		{ExtensionType: 0x000c, ExtensionData: []byte{0xA0}},
+	}
+
+	var decoded []Extension
+	read, err := UnmarshalSlice(encoding, &decoded)
+	require.Nil(t, err)
+	require.Equal(t, read, len(encoding))
+	require.Equal(t, decoded, expected)
+
+	// A partial message at the end is an error, and leaves the slice as-is
+	_, err = UnmarshalSlice(append(encoding, 0x00), &decoded)
+	require.NotNil(t, err)
+	require.Equal(t, decoded, expected)
+
+	_, err = UnmarshalSlice(encoding, decoded)
+	require.NotNil(t, err)
+}
+
+// A ringCollector keeps the last two uint16 elements it receives, along
+// with a count of all of them
+type ringCollector struct {
+	last  [2]uint16
+	count int
+}
+
+func (rc *ringCollector) NewElementTLS() interface{} {
+	return new(uint16)
+}
+
+func (rc *ringCollector) AppendTLS(elem interface{}) {
+	rc.last[rc.count%2] = elem.(uint16)
+	rc.count += 1
+}
+
+func TestDecodeAppender(t *testing.T) {
+	var decoded struct {
+		V ringCollector `tls:"head=1"`
+		W uint8
+	}
+
+	encoding := unhex("06" + "A0A0" + "B0B0" + "C0C0" + "D0")
+	read, err := Unmarshal(encoding, &decoded)
+	require.Nil(t, err)
+	require.Equal(t, read, len(encoding))
+	require.Equal(t, decoded.V.count, 3)
+	require.Equal(t, decoded.V.last, [2]uint16{0xC0C0, 0xB0B0})
+	require.Equal(t, decoded.W, uint8(0xD0))
+
+	// Elements must fill the vector exactly
+	_, err = Unmarshal(unhex("03"+"A0A0"+"B0"), &decoded)
+	require.NotNil(t, err)
+}
+
+// A lossyString decodes the same way as a CrypticString, but encodes without
+// the XOR, so its encoding does not round-trip
+type lossyString string
+
+func (ls lossyString) MarshalTLS() ([]byte, error) {
+	return append([]byte{byte(len(ls))}, ls...), nil
+}
+
+func (ls *lossyString) UnmarshalTLS(data []byte) (int, error) {
+	var cs CrypticString
+	read, err := cs.UnmarshalTLS(data)
+	*ls = lossyString(cs)
+	return read, err
+}
+
+// A ptrMarshaled is a byte string with a one-octet length, encoded by
+// methods with pointer receivers
+type ptrMarshaled []byte
+
+func (pm *ptrMarshaled) MarshalTLS() ([]byte, error) {
+	return append([]byte{byte(len(*pm))}, *pm...), nil
+}
+
+func (pm *ptrMarshaled) UnmarshalTLS(data []byte) (int, error) {
+	if len(data) == 0 || len(data) < 1+int(data[0]) {
+		return 0, errors.New("ptrMarshaled too short")
+	}
+	*pm = append(ptrMarshaled{}, data[1:1+int(data[0])]...)
+	return 1 + int(data[0]), nil
+}
+
+func TestDecodeVerifyRoundtrip(t *testing.T) {
+	opts := DecodeOptions{VerifyRoundtrip: true}
+
+	var ext Extension
+	encoding := unhex("000a0005f0f1f2f3f4")
+	read, err := UnmarshalWithOptions(encoding, &ext, opts)
+	require.Nil(t, err)
+	require.Equal(t, read, len(encoding))
+
+	var lossy struct {
+		A uint8
+		B lossyString
+	}
+	read, err = UnmarshalWithOptions(unhex("A0"+"056e62646565"), &lossy, opts)
+	require.NotNil(t, err)
+	require.Equal(t, read, 0)
+	require.True(t, strings.Contains(err.Error(), "offset 2"), err.Error())
+
+	// Methods with pointer receivers apply on re-encoding
+	var ptr ptrMarshaled
+	read, err = UnmarshalWithOptions(unhex("02"+"A0A1"), &ptr, opts)
+	require.Nil(t, err)
+	require.Equal(t, read, 3)
+
+	// Non-canonical encodings that are accepted also fail to round-trip
+	var varint struct {
+		V uint16 `tls:"varint"`
+	}
+	_, err = UnmarshalWithOptions(unhex("4001"), &varint, opts)
+	require.NotNil(t, err)
+}
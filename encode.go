@@ -2,15 +2,35 @@ package syntax
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"reflect"
 	"runtime"
 	"sort"
+	"strings"
 	"sync"
 )
 
 func Marshal(v interface{}) ([]byte, error) {
-	e := &encodeState{}
+	return MarshalWithOptions(v, EncodeOptions{})
+}
+
+// EncodeOptions control how MarshalWithOptions encodes values.
+type EncodeOptions struct {
+	// OmitTrailingZero causes optional fields at the end of a struct that
+	// point to zero values to be encoded as absent.  Optional fields that
+	// are followed by non-optional fields are unaffected.
+	OmitTrailingZero bool
+
+	// ByteOrder is the byte order for fixed-width integers and length
+	// headers, except in fields tagged `le` or `be`.
+	ByteOrder ByteOrder
+}
+
+func MarshalWithOptions(v interface{}, opts EncodeOptions) ([]byte, error) {
+	e := &encodeState{opts: opts}
 	err := e.marshal(v, fieldOptions{})
 	if err != nil {
 		return nil, err
@@ -18,14 +38,207 @@ func Marshal(v interface{}) ([]byte, error) {
 	return e.Bytes(), nil
 }
 
+// MarshalToBuffer appends the encoding of v to buf.  The buffer is grown
+// once, by the EncodedLength of v, and the value is then encoded directly
+// into it.  If an error occurs, the contents of buf are unchanged.
+func MarshalToBuffer(buf *bytes.Buffer, v interface{}) error {
+	return marshalToBuffer(buf, v, EncodeOptions{})
+}
+
+func marshalToBuffer(buf *bytes.Buffer, v interface{}, opts EncodeOptions) error {
+	n, err := encodedLength(v, opts)
+	if err != nil {
+		return err
+	}
+	buf.Grow(n)
+
+	// The encodeState shares buf's storage, which has room for the whole
+	// encoding, and buf only takes on the result if encoding succeeds
+	e := getEncodeState(nil)
+	defer putEncodeState(e)
+
+	e.Buffer = *buf
+	e.opts = opts
+	if err := e.marshal(v, fieldOptions{}); err != nil {
+		return err
+	}
+
+	*buf = e.Buffer
+	return nil
+}
+
+// EncodedLength returns the length of the encoding of v, or an error if v
+// cannot be encoded.
+func EncodedLength(v interface{}) (int, error) {
+	return encodedLength(v, EncodeOptions{})
+}
+
+func encodedLength(v interface{}, opts EncodeOptions) (int, error) {
+	e := getScratchState()
+	defer putScratchState(e)
+
+	e.opts = opts
+	if err := e.marshal(v, fieldOptions{}); err != nil {
+		return 0, err
+	}
+	return e.Len(), nil
+}
+
+// MarshalTo appends the encoding of v to buf and returns the extended slice.
+// As with append, buf is only reallocated if it lacks the capacity for the
+// encoding.  If an error occurs, buf is returned unchanged.
+func MarshalTo(buf []byte, v interface{}) ([]byte, error) {
+	e := getEncodeState(buf)
+	defer putEncodeState(e)
+
+	if err := e.marshal(v, fieldOptions{}); err != nil {
+		return buf, err
+	}
+	return e.Bytes(), nil
+}
+
 // Marshaler is the interface implemented by types that
 // have a defined TLS encoding.
 type Marshaler interface {
 	MarshalTLS() ([]byte, error)
 }
 
+// FramedMarshaler is the interface implemented by types whose encoding
+// depends on the length header that encloses it.  A field of such a type may
+// carry header tags (e.g., `tls:"head=1"`), in which case the encoding is
+// preceded by a length header, and MarshalTLSFramed is told the framing.
+type FramedMarshaler interface {
+	MarshalTLSFramed(f Framing) ([]byte, error)
+}
+
+// Framing describes the length header that will precede an encoding.
+// HeadSize is the size of a fixed-width header, or zero if the header is a
+// varint or absent.  MaxLength is the largest encoding that the header (and
+// any `max` tag) allows, or -1 if there is no limit.
+type Framing struct {
+	HeadSize  int
+	Varint    bool
+	MaxLength int
+}
+
+// ErrUseDefault may be returned by MarshalTLS to indicate that the value
+// should be encoded using the default reflection-based encoding, as if the
+// type did not implement Marshaler.
+var ErrUseDefault = errors.New("Use default encoding")
+
+// EncodedEqual reports whether a and b have identical TLS encodings.  The
+// encoding of b is checked against the encoding of a as it is produced, so
+// that encoding stops at the first difference.  An error is returned if
+// either value cannot be encoded, unless a difference is found first.
+func EncodedEqual(a, b interface{}) (bool, error) {
+	encA, err := Marshal(a)
+	if err != nil {
+		return false, err
+	}
+
+	e := &encodeState{compare: encA}
+	err = e.marshal(b, fieldOptions{})
+	switch {
+	case err == errEncodingDiffers:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	return e.Len() == len(encA), nil
+}
+
+var errEncodingDiffers = errors.New("Encoding differs")
+
 type encodeState struct {
 	bytes.Buffer
+	opts EncodeOptions
+
+	// If compare is set, the encoding is checked against it as it is written
+	compare     []byte
+	checked     int
+	openHeaders int
+}
+
+var encodeStatePool sync.Pool
+
+// getEncodeState returns an encodeState from the pool that writes into buf
+func getEncodeState(buf []byte) *encodeState {
+	e, ok := encodeStatePool.Get().(*encodeState)
+	if !ok {
+		e = &encodeState{}
+	}
+
+	e.Buffer = *bytes.NewBuffer(buf)
+	return e
+}
+
+// putEncodeState returns an encodeState to the pool, without retaining the
+// caller's buffer
+func putEncodeState(e *encodeState) {
+	*e = encodeState{}
+	encodeStatePool.Put(e)
+}
+
+var scratchStatePool sync.Pool
+
+// getScratchState returns an empty encodeState from the pool, whose buffer
+// may have capacity left over from earlier encodings
+func getScratchState() *encodeState {
+	e, ok := scratchStatePool.Get().(*encodeState)
+	if !ok {
+		e = &encodeState{}
+	}
+	return e
+}
+
+// putScratchState returns an encodeState to the pool, retaining its buffer.
+// The caller must not retain the encoding.
+func putScratchState(e *encodeState) {
+	buf := e.Buffer
+	buf.Reset()
+	*e = encodeState{Buffer: buf}
+	scratchStatePool.Put(e)
+}
+
+// sub returns an encodeState for encoding part of a value separately, e.g.,
+// the body of a vector
+func (e *encodeState) sub() *encodeState {
+	return &encodeState{opts: e.opts}
+}
+
+func (e *encodeState) Write(p []byte) (int, error) {
+	n, err := e.Buffer.Write(p)
+	e.verify()
+	return n, err
+}
+
+func (e *encodeState) WriteString(s string) (int, error) {
+	n, err := e.Buffer.WriteString(s)
+	e.verify()
+	return n, err
+}
+
+func (e *encodeState) WriteByte(c byte) error {
+	err := e.Buffer.WriteByte(c)
+	e.verify()
+	return err
+}
+
+// verify checks any newly written bytes against the comparison encoding.
+// Bytes after a length header that has not been filled in are not checked
+// until the length is known.
+func (e *encodeState) verify() {
+	if e.compare == nil || e.openHeaders > 0 {
+		return
+	}
+
+	written := e.Bytes()[e.checked:]
+	if len(written) > len(e.compare)-e.checked ||
+		!bytes.Equal(written, e.compare[e.checked:e.checked+len(written)]) {
+		panic(errEncodingDiffers)
+	}
+	e.checked = e.Len()
 }
 
 func (e *encodeState) marshal(v interface{}, opts fieldOptions) (err error) {
@@ -64,39 +277,56 @@ func typeEncoder(t reflect.Type) encoderFunc {
 		return fi.(encoderFunc)
 	}
 
-	// XXX(RLB): Wait group based support for recursive types omitted
+	// To deal with recursive types, populate the map with an indirect func
+	// before we build it.  This func waits on the real func (f) to be ready
+	// and then calls it.  This indirect func is only used for recursive
+	// types.
+	var (
+		wg sync.WaitGroup
+		f  encoderFunc
+	)
+	wg.Add(1)
+	fi, loaded := encoderCache.LoadOrStore(t, encoderFunc(func(e *encodeState, v reflect.Value, opts fieldOptions) {
+		wg.Wait()
+		f(e, v, opts)
+	}))
+	if loaded {
+		return fi.(encoderFunc)
+	}
+
+	// If the type cannot be encoded, forget it, so that the error is
+	// reported again on the next attempt
+	defer func() {
+		if r := recover(); r != nil {
+			encoderCache.Delete(t)
+			f = func(e *encodeState, v reflect.Value, opts fieldOptions) { panic(r) }
+			wg.Done()
+			panic(r)
+		}
+	}()
 
 	// Compute the real encoder and replace the indirect func with it.
-	f := newTypeEncoder(t)
+	f = newTypeEncoder(t)
+	wg.Done()
 	encoderCache.Store(t, f)
 	return f
 }
 
 var (
-	marshalerType = reflect.TypeOf(new(Marshaler)).Elem()
+	marshalerType       = reflect.TypeOf(new(Marshaler)).Elem()
+	framedMarshalerType = reflect.TypeOf(new(FramedMarshaler)).Elem()
 )
 
 func newTypeEncoder(t reflect.Type) encoderFunc {
 	var enc encoderFunc
-	if t.Implements(marshalerType) {
+	if t == lazyType {
+		enc = lazyEncoder
+	} else if t.Implements(framedMarshalerType) {
+		enc = framedMarshalerEncoder
+	} else if t.Implements(marshalerType) {
 		enc = marshalerEncoder
 	} else {
-		switch t.Kind() {
-		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-			enc = uintEncoder
-		case reflect.Array:
-			enc = newArrayEncoder(t)
-		case reflect.Slice:
-			enc = newSliceEncoder(t)
-		case reflect.Struct:
-			enc = newStructEncoder(t)
-		case reflect.Map:
-			enc = newMapEncoder(t)
-		case reflect.Ptr:
-			enc = newPointerEncoder(t)
-		default:
-			panic(fmt.Errorf("Unsupported type (%s)", t))
-		}
+		enc = newKindEncoder(t)
 	}
 
 	if t.Implements(validatorType) {
@@ -106,6 +336,48 @@ func newTypeEncoder(t reflect.Type) encoderFunc {
 	return enc
 }
 
+func newKindEncoder(t reflect.Type) encoderFunc {
+	switch t.Kind() {
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return uintEncoder
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return intEncoder
+	case reflect.Bool:
+		return boolEncoder
+	case reflect.String:
+		return stringEncoder
+	case reflect.Array:
+		return newArrayEncoder(t)
+	case reflect.Slice:
+		return newSliceEncoder(t)
+	case reflect.Struct:
+		return newStructEncoder(t)
+	case reflect.Map:
+		return newMapEncoder(t)
+	case reflect.Ptr:
+		return newPointerEncoder(t)
+	case reflect.Interface:
+		return interfaceEncoder
+	default:
+		panic(fmt.Errorf("Unsupported type (%s)", t))
+	}
+}
+
+var defaultEncoderCache sync.Map // map[reflect.Type]encoderFunc
+
+// defaultTypeEncoder returns the reflection-based encoder for a type,
+// ignoring any Marshaler implementation.  It is built lazily, since most
+// Marshaler types never fall back to it.
+func defaultTypeEncoder(t reflect.Type) encoderFunc {
+	if fi, ok := defaultEncoderCache.Load(t); ok {
+		return fi.(encoderFunc)
+	}
+
+	f := newKindEncoder(t)
+	defaultEncoderCache.Store(t, f)
+	return f
+}
+
 ///// Specific encoders below
 
 func omitEncoder(e *encodeState, v reflect.Value, opts fieldOptions) {
@@ -120,12 +392,10 @@ func marshalerEncoder(e *encodeState, v reflect.Value, opts fieldOptions) {
 	}
 
 	if v.Kind() == reflect.Ptr && opts.optional {
+		writePresence(e, !v.IsNil(), opts)
 		if v.IsNil() {
-			writeUint(e, uint64(optionalFlagAbsent), 1)
 			return
 		}
-
-		writeUint(e, uint64(optionalFlagPresent), 1)
 	}
 
 	m, ok := v.Interface().(Marshaler)
@@ -134,6 +404,15 @@ func marshalerEncoder(e *encodeState, v reflect.Value, opts fieldOptions) {
 	}
 
 	b, err := m.MarshalTLS()
+	if err == ErrUseDefault {
+		if v.Kind() == reflect.Ptr {
+			typeEncoder(v.Type().Elem())(e, v.Elem(), opts)
+		} else {
+			defaultTypeEncoder(v.Type())(e, v, opts)
+		}
+		return
+	}
+
 	if err == nil {
 		_, err = e.Write(b)
 	}
@@ -143,6 +422,73 @@ func marshalerEncoder(e *encodeState, v reflect.Value, opts fieldOptions) {
 	}
 }
 
+// framedMarshalerEncoder encodes a FramedMarshaler value that is not framed
+// by a header of its own, e.g., an element of a vector
+func framedMarshalerEncoder(e *encodeState, v reflect.Value, opts fieldOptions) {
+	if v.Kind() == reflect.Ptr && v.IsNil() && !opts.optional {
+		panic(fmt.Errorf("Cannot encode nil pointer"))
+	}
+
+	if v.Kind() == reflect.Ptr && opts.optional {
+		writePresence(e, !v.IsNil(), opts)
+		if v.IsNil() {
+			return
+		}
+	}
+
+	m, ok := v.Interface().(FramedMarshaler)
+	if !ok {
+		panic(fmt.Errorf("Non-FramedMarshaler passed to framedMarshalerEncoder"))
+	}
+
+	// Without a header, the value is encoded as-is.  Header tags that apply
+	// to an enclosing vector do not apply to the value.
+	b, err := m.MarshalTLSFramed(Framing{MaxLength: -1})
+	if err != nil {
+		panic(err)
+	}
+	e.Write(b)
+}
+
+// framedFieldEncoder encodes a field of a FramedMarshaler type with a length
+// header, telling the value how it is framed
+func framedFieldEncoder(e *encodeState, v reflect.Value, opts fieldOptions) {
+	m, ok := v.Interface().(FramedMarshaler)
+	if !ok {
+		panic(fmt.Errorf("Non-FramedMarshaler passed to framedFieldEncoder"))
+	}
+
+	b, err := m.MarshalTLSFramed(framing(opts))
+	if err != nil {
+		panic(err)
+	}
+
+	encodeLength(e, len(b), opts)
+	e.Write(b)
+}
+
+// isFramed reports whether a struct field is a FramedMarshaler with a length
+// header
+func isFramed(t reflect.Type, opts fieldOptions) bool {
+	return t.Implements(framedMarshalerType) && (opts.varintHeader || opts.headerSize > 0)
+}
+
+// framing describes the length header specified by a field's tags
+func framing(opts fieldOptions) Framing {
+	f := Framing{HeadSize: opts.headerSize, Varint: opts.varintHeader, MaxLength: -1}
+	switch {
+	case opts.varintHeader:
+		f.MaxLength = 1<<62 - 1 - opts.lengthBias
+	case opts.headerSize > 0 && opts.headerSize < 8:
+		f.MaxLength = 1<<uint(8*opts.headerSize) - 1 - opts.lengthBias
+	}
+
+	if opts.maxSize > 0 && (f.MaxLength < 0 || opts.maxSize < f.MaxLength) {
+		f.MaxLength = opts.maxSize
+	}
+	return f
+}
+
 //////////
 
 func newValidatorEncoder(raw encoderFunc) encoderFunc {
@@ -159,7 +505,7 @@ func newValidatorEncoder(raw encoderFunc) encoderFunc {
 		}
 
 		if err := val.ValidForTLS(); err != nil {
-			panic(fmt.Errorf("Invalid TLS value: %v", err))
+			panic(fmt.Errorf("Invalid TLS value: %w", err))
 		}
 
 		raw(e, v, opts)
@@ -174,29 +520,113 @@ func uintEncoder(e *encodeState, v reflect.Value, opts fieldOptions) {
 		return
 	}
 
-	writeUint(e, v.Uint(), int(v.Type().Size()))
+	writeUintWithOrder(e, v.Uint(), int(v.Type().Size()), opts.byteOrder(e.opts.ByteOrder))
 }
 
 func varintEncoder(e *encodeState, v reflect.Value, opts fieldOptions) {
+	if opts.varintPad > 0 {
+		writeVarintWithLength(e, v.Uint(), opts.varintPad)
+		return
+	}
+
 	writeVarint(e, v.Uint())
 }
 
-func writeVarint(e *encodeState, u uint64) {
-	if (u >> 62) > 0 {
-		panic(fmt.Errorf("uint value is too big for varint"))
+func intEncoder(e *encodeState, v reflect.Value, opts fieldOptions) {
+	if opts.varint {
+		signedVarintEncoder(e, v, opts)
+		return
+	}
+
+	// Truncating the value to its width yields its two's-complement encoding
+	writeUintWithOrder(e, uint64(v.Int()), int(v.Type().Size()), opts.byteOrder(e.opts.ByteOrder))
+}
+
+// signedVarintEncoder encodes a signed value as a varint whose payload is
+// the two's-complement encoding of the value
+func signedVarintEncoder(e *encodeState, v reflect.Value, opts fieldOptions) {
+	i := v.Int()
+	varintLen := signedVarintLength(i)
+	if opts.varintPad > 0 {
+		if varintLen > opts.varintPad {
+			panic(fmt.Errorf("int value is too big for %d-byte varint", opts.varintPad))
+		}
+		varintLen = opts.varintPad
 	}
 
-	var varintLen int
+	mask := uint64(1)<<uint(8*varintLen-2) - 1
+	writeVarintWithLength(e, uint64(i)&mask, varintLen)
+}
+
+// signedVarintLength returns the length of the minimal varint encoding of a
+// signed value
+func signedVarintLength(i int64) int {
 	for _, len := range []uint{1, 2, 4, 8} {
+		limit := int64(1) << (8*len - 3)
+		if -limit <= i && i < limit {
+			return int(len)
+		}
+	}
+	panic(fmt.Errorf("Value too large for varint [%d]", i))
+}
+
+// boolEncoder encodes a bool as 1 or 0, in one byte unless a width is
+// specified with the `size` tag
+func boolEncoder(e *encodeState, v reflect.Value, opts fieldOptions) {
+	size := opts.fixedSize
+	if size == 0 {
+		size = 1
+	}
+
+	val := uint64(0)
+	if v.Bool() {
+		val = 1
+	}
+
+	writeUintWithOrder(e, val, size, opts.byteOrder(e.opts.ByteOrder))
+}
+
+// maxVarint is the largest value that a varint can hold, since two bits of
+// the largest (8-byte) encoding are used for the length
+const maxVarint = uint64(1)<<62 - 1
+
+func writeVarint(e *encodeState, u uint64) {
+	checkVarintRange(u)
+	writeVarintWithLength(e, u, varintLength(u))
+}
+
+func checkVarintRange(u uint64) {
+	if u > maxVarint {
+		panic(fmt.Errorf("Value too large for varint [%#x > %#x]", u, maxVarint))
+	}
+}
+
+// varintLength returns the length of the minimal varint encoding of a value
+func varintLength(u uint64) int {
+	for _, len := range []uint{1, 2, 4} {
 		if u < (uint64(1) << (8*len - 2)) {
-			varintLen = int(len)
-			break
+			return int(len)
 		}
 	}
+	return 8
+}
 
+// writeVarintWithLength writes a varint of the specified length, which may
+// be longer than the minimal encoding of the value.
+func writeVarintWithLength(e *encodeState, u uint64, varintLen int) {
+	if u >= (uint64(1) << uint(8*varintLen-2)) {
+		panic(fmt.Errorf("uint value is too big for %d-byte varint", varintLen))
+	}
+
+	writeUint(e, varintBits(u, varintLen), varintLen)
+}
+
+// varintBits returns the bits of a varint of the specified length, including
+// the length prefix
+func varintBits(u uint64, varintLen int) uint64 {
 	twoBits := map[int]uint64{1: 0x00, 2: 0x01, 4: 0x02, 8: 0x03}[varintLen]
 	shift := uint(8*varintLen - 2)
-	writeUint(e, u|(twoBits<<shift), varintLen)
+	return u | (twoBits << shift)
 }
 
 func writeUint(e *encodeState, u uint64, len int) {
@@ -205,6 +635,29 @@ func writeUint(e *encodeState, u uint64, len int) {
 	}
 }
 
+func writeUintWithOrder(e *encodeState, u uint64, len int, order ByteOrder) {
+	if order == BigEndian {
+		writeUint(e, u, len)
+		return
+	}
+
+	for i := 0; i < len; i += 1 {
+		e.WriteByte(byte(u >> uint(8*i)))
+	}
+}
+
+// putUint overwrites buf with an integer of the same width
+func putUint(buf []byte, u uint64, order ByteOrder) {
+	n := len(buf)
+	for i := range buf {
+		if order == BigEndian {
+			buf[i] = byte(u >> uint(8*(n-i-1)))
+		} else {
+			buf[i] = byte(u >> uint(8*i))
+		}
+	}
+}
+
 //////////
 
 type arrayEncoder struct {
@@ -214,18 +667,42 @@ type arrayEncoder struct {
 func (ae *arrayEncoder) encode(e *encodeState, v reflect.Value, opts fieldOptions) {
 	n := v.Len()
 	for i := 0; i < n; i += 1 {
-		ae.elemEnc(e, v.Index(i), opts)
+		encodeElement(e, ae.elemEnc, v.Index(i), opts, i)
 	}
 }
 
+// encodeElement encodes element i of a vector, annotating any error with the
+// index of the element.  Elements are encoded in order, so the error
+// reported is always that of the lowest-index invalid element.
+func encodeElement(e *encodeState, enc encoderFunc, v reflect.Value, opts fieldOptions, i int) {
+	defer annotateElementError(i)
+	enc(e, v, opts)
+}
+
 func newArrayEncoder(t reflect.Type) encoderFunc {
 	enc := &arrayEncoder{typeEncoder(t.Elem())}
 	return enc.encode
 }
 
+// bitsEncoder packs an array of bools into ceil(N/8) octets, most
+// significant bit first, with any padding bits set to zero
+func bitsEncoder(e *encodeState, v reflect.Value, opts fieldOptions) {
+	n := v.Len()
+	buf := make([]byte, (n+7)/8)
+	for i := 0; i < n; i += 1 {
+		if v.Index(i).Bool() {
+			buf[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+
+	e.Write(buf)
+}
+
 //////////
 
-func encodeLength(e *encodeState, n int, opts fieldOptions) {
+// checkLength verifies that the length of a vector is within the bounds set
+// by the field's tags, and returns the value to be written in its header
+func checkLength(n int, opts fieldOptions) int {
 	if opts.maxSize > 0 && n > opts.maxSize {
 		panic(fmt.Errorf("Encoded length more than max [%d > %d]", n, opts.maxSize))
 	}
@@ -233,10 +710,42 @@ func encodeLength(e *encodeState, n int, opts fieldOptions) {
 		panic(fmt.Errorf("Encoded length less than min [%d < %d]", n, opts.minSize))
 	}
 
+	n += opts.lengthBias
+	if n < 0 {
+		panic(fmt.Errorf("Biased length is negative [%d]", n))
+	}
+	return n
+}
+
+// checkCount verifies that the number of elements in a vector or map is
+// within the bounds set by the `mincount` and `maxcount` tags
+func checkCount(n int, opts fieldOptions) {
+	if opts.maxCount > 0 && n > opts.maxCount {
+		panic(fmt.Errorf("Element count more than max [%d > %d]", n, opts.maxCount))
+	}
+	if n < opts.minCount {
+		panic(fmt.Errorf("Element count less than min [%d < %d]", n, opts.minCount))
+	}
+}
+
+// checkFixedLength verifies that a vector with a fixed length has exactly
+// that length
+func checkFixedLength(n int, opts fieldOptions) {
+	if n != opts.fixedLength {
+		panic(fmt.Errorf("Vector length does not match fixed length [%d != %d]", n, opts.fixedLength))
+	}
+}
+
+func encodeLength(e *encodeState, n int, opts fieldOptions) {
+	n = checkLength(n, opts)
+
 	switch {
 	case opts.omitHeader:
 		// None.
 
+	case opts.fixedLength > 0:
+		checkFixedLength(n, opts)
+
 	case opts.varintHeader:
 		writeVarint(e, uint64(n))
 
@@ -245,13 +754,95 @@ func encodeLength(e *encodeState, n int, opts fieldOptions) {
 			panic(fmt.Errorf("Encoded length too long for header length [%d, %d]", n, opts.headerSize))
 		}
 
-		writeUint(e, uint64(n), int(opts.headerSize))
+		writeUintWithOrder(e, uint64(n), int(opts.headerSize), opts.byteOrder(e.opts.ByteOrder))
 
 	default:
 		panic(fmt.Errorf("Cannot encode a slice without a header length"))
 	}
 }
 
+// encodeVector encodes a vector whose body is written by the body function.
+// The body is written directly to e, and the length header is filled in once
+// the length of the body is known, so that nested vectors do not need
+// buffers of their own.  A body with a text encoding is still buffered, since
+// the header covers the encoded text.
+func encodeVector(e *encodeState, opts fieldOptions, body func(e *encodeState)) {
+	switch {
+	case opts.encoding != "":
+		bodyState := e.sub()
+		body(bodyState)
+
+		data := textEncode(bodyState.Bytes(), opts.encoding)
+		encodeLength(e, len(data), opts)
+		e.Write(data)
+
+	case opts.omitHeader:
+		start := e.Len()
+		body(e)
+		checkLength(e.Len()-start, opts)
+
+	case opts.fixedLength > 0:
+		start := e.Len()
+		body(e)
+		checkFixedLength(e.Len()-start, opts)
+
+	case opts.varintHeader:
+		// The size of the header depends on the length of the body, so the
+		// body is moved to make room for the header once it is written
+		start := e.Len()
+		e.openHeaders += 1
+		body(e)
+
+		n := uint64(checkLength(e.Len()-start, opts))
+		checkVarintRange(n)
+
+		headerSize := varintLength(n)
+		for i := 0; i < headerSize; i += 1 {
+			e.Buffer.WriteByte(0)
+		}
+
+		buf := e.Bytes()[start:]
+		copy(buf[headerSize:], buf[:len(buf)-headerSize])
+		putUint(buf[:headerSize], varintBits(n, headerSize), BigEndian)
+
+		e.openHeaders -= 1
+		e.verify()
+
+	case opts.headerSize > 0:
+		h := openHeader(e, opts.headerSize, opts.byteOrder(e.opts.ByteOrder))
+		body(e)
+		h.fill(e, checkLength(e.Len()-h.start, opts))
+
+	default:
+		panic(fmt.Errorf("Cannot encode a slice without a header length"))
+	}
+}
+
+//////////
+
+func stringEncoder(e *encodeState, v reflect.Value, opts fieldOptions) {
+	s := v.String()
+	if opts.charset != "" {
+		checkCharset(s, opts.charset)
+	}
+
+	if !opts.cstring {
+		encodeLength(e, len(s), opts)
+		e.WriteString(s)
+		return
+	}
+
+	if len(s) > opts.fixedSize {
+		panic(fmt.Errorf("String too long for C string field [%d > %d]", len(s), opts.fixedSize))
+	}
+	if strings.IndexByte(s, 0) >= 0 {
+		panic(fmt.Errorf("C string contains a NUL byte"))
+	}
+
+	e.WriteString(s)
+	e.Write(make([]byte, opts.fixedSize-len(s)))
+}
+
 //////////
 
 type sliceEncoder struct {
@@ -259,11 +850,48 @@ type sliceEncoder struct {
 }
 
 func (se *sliceEncoder) encode(e *encodeState, v reflect.Value, opts fieldOptions) {
-	arrayState := &encodeState{}
-	se.ae.encode(arrayState, v, opts)
+	if v.IsNil() && opts.required {
+		panic(fmt.Errorf("Cannot encode nil slice for required field"))
+	}
+	checkCount(v.Len(), opts)
+
+	encodeVector(e, opts, func(e *encodeState) {
+		if opts.sparseLen > 0 {
+			se.encodeSparse(e, v, opts)
+		} else {
+			se.ae.encode(e, v, opts)
+		}
+	})
+}
 
-	encodeLength(e, arrayState.Len(), opts)
-	e.Write(arrayState.Bytes())
+// encodeSparse encodes the non-zero elements of a vector as a sequence of
+// (uint16 index, value) pairs, in increasing order of index
+func (se *sliceEncoder) encodeSparse(e *encodeState, v reflect.Value, opts fieldOptions) {
+	n := v.Len()
+	if n > opts.sparseLen {
+		panic(fmt.Errorf("Sparse vector longer than declared length [%d > %d]", n, opts.sparseLen))
+	}
+
+	for i := 0; i < n; i += 1 {
+		elem := v.Index(i)
+		if elem.IsZero() {
+			continue
+		}
+
+		writeUintWithOrder(e, uint64(i), sparseIndexSize, opts.byteOrder(e.opts.ByteOrder))
+		se.ae.elemEnc(e, elem, opts)
+	}
+}
+
+func textEncode(data []byte, encoding string) []byte {
+	switch encoding {
+	case encodingBase64:
+		return []byte(base64.StdEncoding.EncodeToString(data))
+	case encodingHex:
+		return []byte(hex.EncodeToString(data))
+	default:
+		panic(fmt.Errorf("Unknown encoding: %s", encoding))
+	}
 }
 
 func newSliceEncoder(t reflect.Type) encoderFunc {
@@ -274,21 +902,193 @@ func newSliceEncoder(t reflect.Type) encoderFunc {
 //////////
 
 type structEncoder struct {
-	fieldOpts []fieldOptions
-	fieldEncs []encoderFunc
+	fieldNames []string
+	fieldOpts  []fieldOptions
+	fieldEncs  []encoderFunc
+	selectors  []int
+
+	// Index of the select field for which each field is the selector
+	selected []int
+
+	// Fields covered by each checksum field
+	checksums   []*checksumRange
+	hasChecksum bool
+
+	// Index of the flags field for each flag-gated field, and the indices of
+	// the fields gated by each flags field
+	presence []int
+	gated    [][]int
+
+	// Index of the length field for each vector that takes its length from
+	// another field, and of the width field for each vector that takes its
+	// header width from another field.  Both kinds of field are filled in
+	// once the vector is encoded, so lengthTargets holds the index of the
+	// vector for each of them.
+	lengths       []int
+	widths        []int
+	lengthTargets []int
+	hasLengthFrom bool
+
+	// Index of the first of the optional fields at the end of the struct
+	trailingOptional int
 }
 
 func (se *structEncoder) encode(e *encodeState, v reflect.Value, opts fieldOptions) {
+	// The encodings of the fields are only retained if a checksum needs them
+	var spans [][2]int
+	if se.hasChecksum {
+		spans = make([][2]int, len(se.fieldEncs))
+	}
+
+	// Length fields are filled in once the vectors they describe are encoded
+	var lengths []encodeGroup
+	if se.hasLengthFrom {
+		lengths = make([]encodeGroup, len(se.fieldEncs))
+	}
+
+	groups := []encodeGroup{}
 	for i := range se.fieldEncs {
-		se.fieldEncs[i](e, v.Field(i), se.fieldOpts[i])
+		start := e.Len()
+		switch {
+		case se.fieldOpts[i].groupHeaderSize > 0:
+			groups = append(groups, newEncodeGroup(e, se.fieldOpts[i]))
+			continue
+
+		case se.fieldOpts[i].groupEnd:
+			groups[len(groups)-1].end(e)
+			groups = groups[:len(groups)-1]
+			continue
+
+		case se.lengthTargets[i] >= 0:
+			size := int(v.Field(i).Type().Size())
+			lengths[i] = openHeader(e, size, se.fieldOpts[i].byteOrder(e.opts.ByteOrder))
+
+		default:
+			se.encodeField(e, v, i, spans)
+		}
+
+		if se.lengths[i] >= 0 {
+			lengths[se.lengths[i]].fill(e, e.Len()-start)
+		}
+
+		if se.widths[i] >= 0 {
+			lengths[se.widths[i]].fill(e, insertAutoHeader(e, start, se.fieldOpts[i]))
+		}
+
+		if spans != nil {
+			spans[i] = [2]int{start, e.Len()}
+		}
+	}
+
+	for i := len(groups) - 1; i >= 0; i -= 1 {
+		groups[i].end(e)
+	}
+}
+
+func (se *structEncoder) encodeField(e *encodeState, v reflect.Value, i int, spans [][2]int) {
+	defer annotateFieldError(se.fieldNames[i])
+
+	omitZero := se.fieldOpts[i].omitEmpty || (e.opts.OmitTrailingZero && i >= se.trailingOptional)
+	if omitZero && se.fieldOpts[i].optional && pointsToZero(v.Field(i)) {
+		se.fieldEncs[i](e, reflect.Zero(v.Field(i).Type()), se.fieldOpts[i])
+		return
 	}
+
+	if se.presence[i] >= 0 && v.Field(i).IsNil() {
+		return
+	}
+
+	if f := v.Field(i); f.Kind() == reflect.Ptr && f.IsNil() && !se.fieldOpts[i].optional &&
+		!se.fieldOpts[i].omit {
+		panic(fmt.Errorf("Cannot encode nil pointer without optional tag"))
+	}
+
+	if se.selectors[i] >= 0 {
+		variantEncoder(e, v.Field(i), v.Field(se.selectors[i]), se.fieldOpts[i])
+		return
+	}
+
+	field := v.Field(i)
+	switch {
+	case se.selected[i] >= 0 && v.Field(se.selected[i]).IsNil():
+		field, _ = absentSelector(field)
+
+	case se.checksums[i] != nil:
+		fieldData := make([][]byte, len(spans))
+		for j, span := range spans {
+			fieldData[j] = e.Bytes()[span[0]:span[1]]
+		}
+
+		field = reflect.New(field.Type()).Elem()
+		field.SetUint(se.checksums[i].sum(fieldData))
+	}
+
+	if len(se.gated[i]) > 0 {
+		field = presenceFlags(field, v, se.gated[i], se.fieldOpts)
+	}
+
+	se.fieldEncs[i](e, field, se.fieldOpts[i])
+}
+
+func pointsToZero(v reflect.Value) bool {
+	return v.Kind() == reflect.Ptr && !v.IsNil() && v.Elem().IsZero()
+}
+
+// An encodeGroup tracks a fixed-size length header that is filled in once
+// the data it covers has been encoded, e.g., for a group of fields
+type encodeGroup struct {
+	headerSize int
+	order      ByteOrder
+	start      int
+}
+
+func newEncodeGroup(e *encodeState, opts fieldOptions) encodeGroup {
+	return openHeader(e, opts.groupHeaderSize, opts.byteOrder(e.opts.ByteOrder))
+}
+
+// openHeader writes a placeholder for a length header
+func openHeader(e *encodeState, headerSize int, order ByteOrder) encodeGroup {
+	e.openHeaders += 1
+	writeUint(e, 0, headerSize)
+	return encodeGroup{headerSize, order, e.Len()}
+}
+
+func (g encodeGroup) end(e *encodeState) {
+	g.fill(e, e.Len()-g.start)
+}
+
+// fill writes the value n to the length header
+func (g encodeGroup) fill(e *encodeState, n int) {
+	if n>>uint(8*g.headerSize) > 0 {
+		panic(fmt.Errorf("Encoded length too long for header length [%d, %d]", n, g.headerSize))
+	}
+
+	putUint(e.Bytes()[g.start-g.headerSize:g.start], uint64(n), g.order)
+
+	e.openHeaders -= 1
+	e.verify()
 }
 
 func newStructEncoder(t reflect.Type) encoderFunc {
 	n := t.NumField()
 	se := structEncoder{
-		fieldOpts: make([]fieldOptions, n),
-		fieldEncs: make([]encoderFunc, n),
+		fieldNames: make([]string, n),
+		fieldOpts:  make([]fieldOptions, n),
+		fieldEncs:  make([]encoderFunc, n),
+		selectors:  make([]int, n),
+		selected:   make([]int, n),
+		checksums:  make([]*checksumRange, n),
+		presence:   make([]int, n),
+		gated:      make([][]int, n),
+
+		lengths:       make([]int, n),
+		widths:        make([]int, n),
+		lengthTargets: make([]int, n),
+	}
+
+	for i := range se.selected {
+		se.selected[i] = -1
+		se.lengthTargets[i] = -1
 	}
 
 	for i := 0; i < n; i += 1 {
@@ -300,14 +1100,77 @@ func newStructEncoder(t reflect.Type) encoderFunc {
 			panic(fmt.Errorf("Tags invalid for field type"))
 		}
 
+		se.fieldNames[i] = f.Name
 		se.fieldOpts[i] = opts
-		if opts.omit {
+		se.selectors[i] = selectorIndex(t, i, opts)
+		if se.selectors[i] >= 0 {
+			se.selected[se.selectors[i]] = i
+		}
+
+		se.checksums[i] = checksumFields(t, i, opts)
+		if se.checksums[i] != nil {
+			se.hasChecksum = true
+		}
+
+		se.presence[i] = presenceIndex(t, i, opts)
+		if se.presence[i] >= 0 {
+			se.gated[se.presence[i]] = append(se.gated[se.presence[i]], i)
+		}
+
+		se.lengths[i] = lengthFromIndex(t, i, opts)
+		if j := se.lengths[i]; j >= 0 {
+			if se.lengthTargets[j] >= 0 {
+				panic(fmt.Errorf("Length field %s is used by more than one field", opts.lengthFrom))
+			}
+
+			se.lengthTargets[j] = i
+			se.hasLengthFrom = true
+
+			// The vector itself is encoded without a header
+			opts.omitHeader = true
+			se.fieldOpts[i] = opts
+		}
+
+		se.widths[i] = widthFromIndex(t, i, opts)
+		if j := se.widths[i]; j >= 0 {
+			if se.lengthTargets[j] >= 0 {
+				panic(fmt.Errorf("Width field %s is used by more than one field", opts.widthFrom))
+			}
+
+			se.lengthTargets[j] = i
+			se.hasLengthFrom = true
+
+			// The vector is encoded without a header, and the header is
+			// inserted once its length is known
+			opts.omitHeader = true
+			se.fieldOpts[i] = opts
+		}
+
+		if opts.omit || opts.groupHeaderSize > 0 || opts.groupEnd {
 			se.fieldEncs[i] = omitEncoder
+		} else if se.selectors[i] >= 0 {
+			se.fieldEncs[i] = nil
+		} else if opts.bits {
+			se.fieldEncs[i] = bitsEncoder
+		} else if isFramed(f.Type, opts) {
+			se.fieldEncs[i] = framedFieldEncoder
+			if f.Type.Implements(validatorType) {
+				se.fieldEncs[i] = newValidatorEncoder(se.fieldEncs[i])
+			}
 		} else {
 			se.fieldEncs[i] = typeEncoder(f.Type)
 		}
 	}
 
+	if !groupsBalanced(se.fieldOpts) {
+		panic(fmt.Errorf("Group end without matching group start"))
+	}
+
+	se.trailingOptional = n
+	for i := n - 1; i >= 0 && (se.fieldOpts[i].optional || se.fieldOpts[i].omit); i -= 1 {
+		se.trailingOptional = i
+	}
+
 	return se.encode
 }
 
@@ -319,19 +1182,55 @@ type mapEncoder struct {
 }
 
 type encMap struct {
+	keys    []reflect.Value
+	vals    []reflect.Value
 	keyEncs [][]byte
 	valEncs [][]byte
+	numeric bool
 }
 
 func (em encMap) Len() int { return len(em.keyEncs) }
 
 func (em *encMap) Swap(i, j int) {
+	em.keys[i], em.keys[j] = em.keys[j], em.keys[i]
+	em.vals[i], em.vals[j] = em.vals[j], em.vals[i]
 	em.keyEncs[i], em.keyEncs[j] = em.keyEncs[j], em.keyEncs[i]
 	em.valEncs[i], em.valEncs[j] = em.valEncs[j], em.valEncs[i]
 }
 
 func (em encMap) Less(i, j int) bool {
-	return bytes.Compare(em.keyEncs[i], em.keyEncs[j]) < 0
+	return compareKeys(em.keys[i], em.keys[j], em.keyEncs[i], em.keyEncs[j], em.numeric) < 0
+}
+
+// compareKeys compares two map keys in the order in which they are encoded.
+// By default, keys are ordered by their encodings, so that the order is
+// well-defined for any key type.  With the `order=numeric` tag, integer keys
+// are ordered by value, which differs for signed or little-endian keys.
+func compareKeys(a, b reflect.Value, aEnc, bEnc []byte, numeric bool) int {
+	switch {
+	case !numeric:
+		return bytes.Compare(aEnc, bEnc)
+
+	case isIntKind(a.Kind()):
+		x, y := a.Int(), b.Int()
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+
+	default:
+		x, y := a.Uint(), b.Uint()
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
 }
 
 func (em encMap) Size() int {
@@ -350,28 +1249,55 @@ func (em encMap) Encode(e *encodeState) {
 }
 
 func (me *mapEncoder) encode(e *encodeState, v reflect.Value, opts fieldOptions) {
+	if v.IsNil() && opts.required {
+		panic(fmt.Errorf("Cannot encode nil map for required field"))
+	}
+	checkCount(v.Len(), opts)
+
 	enc := &encMap{
+		keys:    make([]reflect.Value, v.Len()),
+		vals:    make([]reflect.Value, v.Len()),
 		keyEncs: make([][]byte, v.Len()),
 		valEncs: make([][]byte, v.Len()),
+		numeric: opts.numericKeys,
 	}
-	nullOpts := fieldOptions{}
 	it := v.MapRange()
 	for i := 0; i < enc.Len() && it.Next(); i++ {
-		keyState := &encodeState{}
-		me.keyEnc(keyState, it.Key(), nullOpts)
-		enc.keyEncs[i] = keyState.Bytes()
-
-		valState := &encodeState{}
-		me.valEnc(valState, it.Value(), nullOpts)
-		enc.valEncs[i] = valState.Bytes()
+		enc.keys[i], enc.vals[i] = it.Key(), it.Value()
+		enc.keyEncs[i] = me.encodeKey(e, it.Key())
 	}
 
+	// Values are encoded in sorted order, so that errors report the same
+	// position on every run
 	sort.Sort(enc)
+	for i := range enc.vals {
+		enc.valEncs[i] = me.encodeValue(e, enc.vals[i], i)
+	}
 
 	encodeLength(e, enc.Size(), opts)
 	enc.Encode(e)
 }
 
+// encodeKey encodes a map key.  Since the entry has no position until its
+// key is encoded, any error is annotated with the key itself.
+func (me *mapEncoder) encodeKey(e *encodeState, key reflect.Value) []byte {
+	defer annotateFieldError(fmt.Sprintf("[%v]", key.Interface()))
+
+	keyState := e.sub()
+	me.keyEnc(keyState, key, fieldOptions{})
+	return keyState.Bytes()
+}
+
+// encodeValue encodes the value of entry i of a map, in sorted order,
+// annotating any error with the position of the entry
+func (me *mapEncoder) encodeValue(e *encodeState, val reflect.Value, i int) []byte {
+	defer annotateElementError(i)
+
+	valState := e.sub()
+	me.valEnc(valState, val, fieldOptions{})
+	return valState.Bytes()
+}
+
 func newMapEncoder(t reflect.Type) encoderFunc {
 	me := mapEncoder{
 		keyEnc: typeEncoder(t.Key()),
@@ -392,18 +1318,47 @@ func (pe pointerEncoder) encode(e *encodeState, v reflect.Value, opts fieldOptio
 		panic(fmt.Errorf("Cannot encode nil pointer"))
 	}
 
-	if opts.optional {
+	if opts.absent != nil {
+		size := int(v.Type().Elem().Size())
 		if v.IsNil() {
-			writeUint(e, uint64(optionalFlagAbsent), 1)
+			writeUintWithOrder(e, *opts.absent, size, opts.byteOrder(e.opts.ByteOrder))
 			return
 		}
 
-		writeUint(e, uint64(optionalFlagPresent), 1)
+		if v.Elem().Uint() == *opts.absent {
+			panic(fmt.Errorf("Present optional has the value of the absence marker: %#x", *opts.absent))
+		}
+
+		pe.base(e, v.Elem(), opts)
+		return
+	}
+
+	if opts.optional {
+		writePresence(e, !v.IsNil(), opts)
+		if v.IsNil() {
+			return
+		}
 	}
 
 	pe.base(e, v.Elem(), opts)
 }
 
+// writePresence writes the presence field of an optional, which is a single
+// octet unless a wider one is specified with the `presence` tag
+func writePresence(e *encodeState, present bool, opts fieldOptions) {
+	flag := uint64(optionalFlagAbsent)
+	if present {
+		flag = uint64(optionalFlagPresent)
+	}
+
+	if opts.presenceSize == 0 {
+		writeUint(e, flag, 1)
+		return
+	}
+
+	writeUintWithOrder(e, flag, opts.presenceSize, opts.byteOrder(e.opts.ByteOrder))
+}
+
 func newPointerEncoder(t reflect.Type) encoderFunc {
 	baseEncoder := typeEncoder(t.Elem())
 	pe := pointerEncoder{base: baseEncoder}
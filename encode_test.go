@@ -1,6 +1,9 @@
 package syntax
 
 import (
+	"bytes"
+	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -15,6 +18,22 @@ func TestEncodeErrors(t *testing.T) {
 			V uint64 `tls:"varint"`
 		}{V: uint64(1) << 63},
 
+		"varint-just-too-big": struct {
+			V uint64 `tls:"varint"`
+		}{V: 0x4000000000000000},
+
+		"varint-too-big-for-pad": struct {
+			V uint16 `tls:"varint,pad=1"`
+		}{V: 0x40},
+
+		"varint-signed-too-big": struct {
+			V int64 `tls:"varint"`
+		}{V: 1 << 61},
+
+		"varint-signed-too-big-for-pad": struct {
+			V int16 `tls:"varint,pad=1"`
+		}{V: -33},
+
 		"no-head": struct {
 			V []byte
 		}{V: buffer(0x20)},
@@ -23,6 +42,30 @@ func TestEncodeErrors(t *testing.T) {
 			V []byte `tls:"head=1"`
 		}{V: buffer(0x100)},
 
+		"fixed-too-short": struct {
+			V []byte `tls:"fixed=32"`
+		}{V: buffer(31)},
+
+		"fixed-too-long": struct {
+			V []byte `tls:"fixed=32"`
+		}{V: buffer(33)},
+
+		"fixed-nil": struct {
+			V []byte `tls:"fixed=32"`
+		}{V: nil},
+
+		"optional-sentinel-present": struct {
+			V *uint16 `tls:"optional,absent=0x0000"`
+		}{V: new(uint16)},
+
+		"bias-too-long": struct {
+			V []byte `tls:"head=1,bias=1"`
+		}{V: buffer(0xFF)},
+
+		"bias-negative": struct {
+			V []byte `tls:"head=1,bias=-1"`
+		}{V: []byte{}},
+
 		"overflow": struct {
 			V []byte `tls:"head=1,max=31"`
 		}{V: buffer(0x20)},
@@ -31,8 +74,37 @@ func TestEncodeErrors(t *testing.T) {
 			V []byte `tls:"head=1,min=33"`
 		}{V: buffer(0x20)},
 
+		"sparse-too-long": struct {
+			V []uint16 `tls:"head=1,sparse=2"`
+		}{V: []uint16{1, 2, 3}},
+
+		"string-no-head": struct {
+			V string
+		}{V: "hello"},
+
+		"cstring-too-long": struct {
+			V string `tls:"size=4,cstring"`
+		}{V: "hello"},
+
+		"cstring-nul": struct {
+			V string `tls:"size=4,cstring"`
+		}{V: "h\x00i"},
+
 		"nil": struct{ V *uint8 }{V: nil},
 
+		"group-too-long": struct {
+			_ struct{} `tls:"group=1"`
+			V []byte   `tls:"head=1"`
+		}{V: buffer(0xFF)},
+
+		"nil-map-required": struct {
+			V map[uint8]uint8 `tls:"head=2,min=1,required"`
+		}{V: nil},
+
+		"nil-slice-required": struct {
+			V []byte `tls:"head=2,required"`
+		}{V: nil},
+
 		"invalid-head-tag": struct {
 			V int `tls:"head=2"`
 		}{V: 0},
@@ -53,3 +125,549 @@ func TestEncodeErrors(t *testing.T) {
 		require.NotNil(t, err, label)
 	}
 }
+
+func TestEncodeVarintRange(t *testing.T) {
+	encoding, err := Marshal(struct {
+		V uint64 `tls:"varint"`
+	}{V: 0x3FFFFFFFFFFFFFFF})
+	require.Nil(t, err)
+	require.Equal(t, encoding, unhex("FFFFFFFFFFFFFFFF"))
+
+	_, err = Marshal(struct {
+		V uint64 `tls:"varint"`
+	}{V: 0x4000000000000000})
+	require.NotNil(t, err)
+	require.True(t, strings.Contains(err.Error(), "too large for varint"), err.Error())
+}
+
+func TestEncodeNilMap(t *testing.T) {
+	encoding, err := Marshal(struct {
+		V map[uint8]uint8 `tls:"head=2"`
+	}{V: nil})
+	require.Nil(t, err)
+	require.Equal(t, encoding, unhex("0000"))
+
+	encoding, err = Marshal(struct {
+		V map[uint8]uint8 `tls:"head=2,required"`
+	}{V: map[uint8]uint8{}})
+	require.Nil(t, err)
+	require.Equal(t, encoding, unhex("0000"))
+
+	_, err = Marshal(struct {
+		V map[uint8]uint8 `tls:"head=2,required"`
+	}{V: nil})
+	require.NotNil(t, err)
+}
+
+func TestMapKeyOrder(t *testing.T) {
+	type signedMap struct {
+		V map[int8]uint8 `tls:"head=1"`
+	}
+	type numericSignedMap struct {
+		V map[int8]uint8 `tls:"head=1,order=numeric"`
+	}
+	type uintMap struct {
+		V map[uint16]uint8 `tls:"head=1"`
+	}
+	type numericUintMap struct {
+		V map[uint16]uint8 `tls:"head=1,order=numeric"`
+	}
+	type marshalerMap struct {
+		V map[CrypticString]uint8 `tls:"head=1"`
+	}
+
+	signed := map[int8]uint8{-1: 0xA0, 1: 0xA1}
+	unsigned := map[uint16]uint8{0x0001: 0xA0, 0x0100: 0xA1}
+
+	cases := map[string]struct {
+		value     interface{}
+		byteOrder ByteOrder
+		encoding  []byte
+		reordered []byte
+	}{
+		// By default, keys are ordered by their encodings
+		"signed": {
+			value:     signedMap{V: signed},
+			encoding:  unhex("04" + "01A1" + "FFA0"),
+			reordered: unhex("04" + "FFA0" + "01A1"),
+		},
+		"little-endian": {
+			value:     uintMap{V: unsigned},
+			byteOrder: LittleEndian,
+			encoding:  unhex("06" + "0001A1" + "0100A0"),
+			reordered: unhex("06" + "0100A0" + "0001A1"),
+		},
+		"marshaler": {
+			value:     marshalerMap{V: map[CrypticString]uint8{"a": 1, "b": 2, "c": 3}},
+			encoding:  unhex("09" + "016002" + "016103" + "016301"),
+			reordered: unhex("09" + "016301" + "016002" + "016103"),
+		},
+
+		// With order=numeric, integer keys are ordered by value
+		"numeric-signed": {
+			value:     numericSignedMap{V: signed},
+			encoding:  unhex("04" + "FFA0" + "01A1"),
+			reordered: unhex("04" + "01A1" + "FFA0"),
+		},
+		"numeric-little-endian": {
+			value:     numericUintMap{V: unsigned},
+			byteOrder: LittleEndian,
+			encoding:  unhex("06" + "0100A0" + "0001A1"),
+			reordered: unhex("06" + "0001A1" + "0100A0"),
+		},
+	}
+
+	for label, testCase := range cases {
+		encoding, err := MarshalWithOptions(testCase.value, EncodeOptions{ByteOrder: testCase.byteOrder})
+		require.Nil(t, err, label)
+		require.Equal(t, encoding, testCase.encoding, label)
+
+		// The encoding round-trips, and re-encoding reproduces it exactly
+		decoded := reflect.New(reflect.TypeOf(testCase.value))
+		opts := DecodeOptions{Strict: true, ByteOrder: testCase.byteOrder}
+		_, err = UnmarshalWithOptions(encoding, decoded.Interface(), opts)
+		require.Nil(t, err, label)
+		require.Equal(t, decoded.Elem().Interface(), testCase.value, label)
+
+		reencoded, err := MarshalWithOptions(decoded.Elem().Interface(), EncodeOptions{ByteOrder: testCase.byteOrder})
+		require.Nil(t, err, label)
+		require.Equal(t, reencoded, encoding, label)
+
+		// Keys in any other order are rejected in strict mode
+		_, err = UnmarshalWithOptions(testCase.reordered, decoded.Interface(), opts)
+		require.NotNil(t, err, label)
+		require.True(t, strings.Contains(err.Error(), "Map keys out of order"), err.Error())
+	}
+}
+
+func TestEncodeNilPointer(t *testing.T) {
+	_, err := Marshal(struct {
+		V *uint16
+	}{V: nil})
+	require.NotNil(t, err)
+	require.True(t, strings.Contains(err.Error(), "field V:"), err.Error())
+	require.True(t, strings.Contains(err.Error(), "nil pointer"), err.Error())
+
+	encoding, err := Marshal(struct {
+		V *uint16 `tls:"optional"`
+	}{V: nil})
+	require.Nil(t, err)
+	require.Equal(t, encoding, unhex("00"))
+}
+
+func TestEncodeOmitEmpty(t *testing.T) {
+	zero16 := uint16(0)
+	nonZero16 := uint16(0xB0B1)
+	type message struct {
+		A *uint16 `tls:"optional,omitempty"`
+		B uint8
+	}
+
+	encoding, err := Marshal(message{A: &zero16, B: 0xC0})
+	require.Nil(t, err)
+	require.Equal(t, encoding, unhex("00"+"C0"))
+
+	encoding, err = Marshal(message{A: &nonZero16, B: 0xC0})
+	require.Nil(t, err)
+	require.Equal(t, encoding, unhex("01B0B1"+"C0"))
+
+	// An omitted zero value decodes as absent
+	var decoded message
+	_, err = Unmarshal(unhex("00"+"C0"), &decoded)
+	require.Nil(t, err)
+	require.Equal(t, decoded, message{A: nil, B: 0xC0})
+
+	// Without a presence octet, omitting a zero value would be ambiguous
+	_, err = Marshal(struct {
+		A uint16 `tls:"omitempty"`
+	}{})
+	require.NotNil(t, err)
+}
+
+// A HybridVersion encodes as a single octet when it fits, and otherwise
+// falls back to the default two-octet encoding.
+type HybridVersion uint16
+
+func (hv HybridVersion) MarshalTLS() ([]byte, error) {
+	if hv > 0xFF {
+		return nil, ErrUseDefault
+	}
+	return []byte{byte(hv)}, nil
+}
+
+func TestMarshalerUseDefault(t *testing.T) {
+	small := HybridVersion(0x0A)
+	large := HybridVersion(0xB0A0)
+	cases := map[string]struct {
+		value    interface{}
+		encoding []byte
+	}{
+		"custom":  {value: small, encoding: unhex("0A")},
+		"default": {value: large, encoding: unhex("B0A0")},
+		"struct": {
+			value: struct {
+				A HybridVersion
+				B HybridVersion
+			}{A: small, B: large},
+			encoding: unhex("0AB0A0"),
+		},
+		"optional": {
+			value: struct {
+				A *HybridVersion `tls:"optional"`
+			}{A: &large},
+			encoding: unhex("01B0A0"),
+		},
+	}
+
+	for label, testCase := range cases {
+		encoding, err := Marshal(testCase.value)
+		require.Nil(t, err, label)
+		require.Equal(t, encoding, testCase.encoding, label)
+	}
+}
+
+func TestEncodedEqual(t *testing.T) {
+	type grouped struct {
+		A uint8
+		_ struct{} `tls:"group=2"`
+		B []uint16 `tls:"head=1"`
+	}
+
+	cases := []struct {
+		a, b  interface{}
+		equal bool
+	}{
+		{a: uint16(0xA0A1), b: uint16(0xA0A1), equal: true},
+		{a: uint16(0xA0A1), b: [2]uint8{0xA0, 0xA1}, equal: true},
+		{a: uint16(0xA0A1), b: uint16(0xA0A2), equal: false},
+		{a: uint16(0xA0A1), b: uint8(0xA0), equal: false},
+		{a: uint8(0xA0), b: uint16(0xA0A1), equal: false},
+		{a: chValidIn, b: chValidIn, equal: true},
+		{a: chValidIn, b: shValidIn, equal: false},
+		{
+			a:     grouped{A: 1, B: []uint16{2, 3}},
+			b:     grouped{A: 1, B: []uint16{2, 3}},
+			equal: true,
+		},
+		{
+			a:     grouped{A: 1, B: []uint16{2, 3}},
+			b:     grouped{A: 1, B: []uint16{2, 4}},
+			equal: false,
+		},
+		{
+			// The difference is found before the invalid value is reached
+			a: struct{ A, B uint8 }{A: 1, B: 2},
+			b: struct {
+				A uint8
+				B *uint8
+			}{A: 2, B: nil},
+			equal: false,
+		},
+	}
+
+	for i, c := range cases {
+		equal, err := EncodedEqual(c.a, c.b)
+		require.Nil(t, err, i)
+		require.Equal(t, equal, c.equal, i)
+	}
+
+	_, err := EncodedEqual(float64(0), uint8(0))
+	require.NotNil(t, err)
+
+	_, err = EncodedEqual(uint8(0), float64(0))
+	require.NotNil(t, err)
+}
+
+func TestEncodeOmitTrailingZero(t *testing.T) {
+	zero16 := uint16(0)
+	zero32 := uint32(0)
+	nonZero32 := uint32(0xA0A1A2A3)
+	type message struct {
+		A *uint16 `tls:"optional"`
+		B uint8
+		C *uint16 `tls:"optional"`
+		D *uint32 `tls:"optional"`
+		E *uint32 `tls:"omit"`
+	}
+
+	cases := []struct {
+		value   message
+		full    []byte
+		omitted []byte
+	}{
+		{
+			value:   message{A: &zero16, B: 0xB0, C: &zero16, D: &zero32},
+			full:    unhex("010000" + "B0" + "010000" + "0100000000"),
+			omitted: unhex("010000" + "B0" + "00" + "00"),
+		},
+		{
+			value:   message{A: &zero16, B: 0xB0, C: &zero16, D: &nonZero32, E: &zero32},
+			full:    unhex("010000" + "B0" + "010000" + "01A0A1A2A3"),
+			omitted: unhex("010000" + "B0" + "00" + "01A0A1A2A3"),
+		},
+		{
+			value:   message{A: nil, B: 0xB0, C: nil, D: nil},
+			full:    unhex("00" + "B0" + "00" + "00"),
+			omitted: unhex("00" + "B0" + "00" + "00"),
+		},
+	}
+
+	for _, c := range cases {
+		full, err := Marshal(c.value)
+		require.Nil(t, err)
+		require.Equal(t, full, c.full)
+
+		omitted, err := MarshalWithOptions(c.value, EncodeOptions{OmitTrailingZero: true})
+		require.Nil(t, err)
+		require.Equal(t, omitted, c.omitted)
+	}
+}
+
+func TestMarshalToBuffer(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write([]byte{0xFF})
+
+	err := MarshalToBuffer(&buf, extValidIn)
+	require.Nil(t, err)
+	require.Equal(t, buf.Bytes(), append([]byte{0xFF}, unhex("000a0005f0f1f2f3f4")...))
+
+	// The buffer is unchanged on error
+	err = MarshalToBuffer(&buf, struct {
+		A uint8
+		B float64
+	}{})
+	require.NotNil(t, err)
+	require.Equal(t, buf.Bytes(), append([]byte{0xFF}, unhex("000a0005f0f1f2f3f4")...))
+
+	// Repeated encodings do not disturb one another's output
+	err = MarshalToBuffer(&buf, uint16(0xA0A1))
+	require.Nil(t, err)
+	require.Equal(t, buf.Bytes(), append([]byte{0xFF}, unhex("000a0005f0f1f2f3f4"+"A0A1")...))
+}
+
+func TestEncodedLength(t *testing.T) {
+	n, err := EncodedLength(extValidIn)
+	require.Nil(t, err)
+	require.Equal(t, n, len(unhex("000a0005f0f1f2f3f4")))
+
+	_, err = EncodedLength(float64(0))
+	require.NotNil(t, err)
+}
+
+func BenchmarkMarshalToBuffer(b *testing.B) {
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	for i := 0; i < b.N; i += 1 {
+		buf.Reset()
+		if err := MarshalToBuffer(&buf, extValidIn); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMarshalTo(t *testing.T) {
+	buf := make([]byte, 1, 64)
+	buf[0] = 0xFF
+
+	out, err := MarshalTo(buf, extValidIn)
+	require.Nil(t, err)
+	require.Equal(t, out, append([]byte{0xFF}, unhex("000a0005f0f1f2f3f4")...))
+
+	// The encoding is written into the existing capacity
+	require.Equal(t, &out[0], &buf[0])
+
+	// The buffer grows if necessary
+	out, err = MarshalTo(out[:1:1], extValidIn)
+	require.Nil(t, err)
+	require.Equal(t, out, append([]byte{0xFF}, unhex("000a0005f0f1f2f3f4")...))
+
+	// The buffer is returned unchanged on error
+	out, err = MarshalTo(buf, struct {
+		A uint8
+		B float64
+	}{})
+	require.NotNil(t, err)
+	require.Equal(t, out, []byte{0xFF})
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i += 1 {
+		if _, err := Marshal(extValidIn); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalTo(b *testing.B) {
+	buf := make([]byte, 0, 64)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i += 1 {
+		var err error
+		if buf, err = MarshalTo(buf[:0], extValidIn); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalAndWrite(b *testing.B) {
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	for i := 0; i < b.N; i += 1 {
+		buf.Reset()
+		data, err := Marshal(extValidIn)
+		if err != nil {
+			b.Fatal(err)
+		}
+		buf.Write(data)
+	}
+}
+
+func TestEncodeElementValidation(t *testing.T) {
+	// The elements at indices 2 and 4 are forbidden.  The error must report
+	// index 2.
+	_, err := Marshal(struct {
+		V []CrypticString `tls:"head=1"`
+	}{
+		V: []CrypticString{"hello", "hello", "fnord", "hello", "fnord"},
+	})
+	require.NotNil(t, err)
+	require.True(t, strings.Contains(err.Error(), "field V[2]:"), err.Error())
+	require.True(t, strings.Contains(err.Error(), "Forbidden value"), err.Error())
+}
+
+// An AdaptiveUint is encoded in as few octets as possible when the framing
+// header is a single octet, and in four octets otherwise.
+type AdaptiveUint uint32
+
+func (au AdaptiveUint) MarshalTLSFramed(f Framing) ([]byte, error) {
+	if f.HeadSize != 1 {
+		return []byte{byte(au >> 24), byte(au >> 16), byte(au >> 8), byte(au)}, nil
+	}
+
+	var b []byte
+	for v := au; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	return b, nil
+}
+
+func (au *AdaptiveUint) UnmarshalTLS(data []byte) (int, error) {
+	if len(data) > 4 {
+		return 0, fmt.Errorf("AdaptiveUint too long")
+	}
+
+	*au = 0
+	for _, b := range data {
+		*au = (*au << 8) + AdaptiveUint(b)
+	}
+	return len(data), nil
+}
+
+func TestFramedMarshaler(t *testing.T) {
+	type adaptiveStruct struct {
+		Short AdaptiveUint `tls:"head=1"`
+		Long  AdaptiveUint `tls:"head=2"`
+	}
+
+	value := adaptiveStruct{Short: 0x0102, Long: 0x0102}
+	encoding := unhex("02" + "0102" + "0004" + "00000102")
+
+	out, err := Marshal(value)
+	require.Nil(t, err)
+	require.Equal(t, out, encoding)
+
+	var decoded adaptiveStruct
+	read, err := Unmarshal(encoding, &decoded)
+	require.Nil(t, err)
+	require.Equal(t, read, len(encoding))
+	require.Equal(t, decoded, value)
+
+	// Without a header, the value is told that there is no framing
+	out, err = Marshal(AdaptiveUint(0x0102))
+	require.Nil(t, err)
+	require.Equal(t, out, unhex("00000102"))
+
+	// An optional pointer carries a presence octet
+	type optionalStruct struct {
+		V *AdaptiveUint `tls:"optional"`
+	}
+
+	v := AdaptiveUint(0x0102)
+	optionalCases := map[string]struct {
+		value    optionalStruct
+		encoding []byte
+	}{
+		"absent":  {value: optionalStruct{}, encoding: unhex("00")},
+		"present": {value: optionalStruct{V: &v}, encoding: unhex("01" + "00000102")},
+	}
+
+	for label, testCase := range optionalCases {
+		out, err := Marshal(testCase.value)
+		require.Nil(t, err, label)
+		require.Equal(t, out, testCase.encoding, label)
+
+		var decodedOptional optionalStruct
+		read, err := Unmarshal(out, &decodedOptional)
+		require.Nil(t, err, label)
+		require.Equal(t, read, len(out), label)
+		require.Equal(t, decodedOptional, testCase.value, label)
+	}
+}
+
+func TestMarshalMinimalVarintHead(t *testing.T) {
+	type inner struct {
+		Data []byte `tls:"head=varint"`
+	}
+	type middle struct {
+		Inners []inner `tls:"head=varint"`
+	}
+	type outer struct {
+		Middles []middle `tls:"head=varint"`
+	}
+
+	// Each level gets the narrowest header for its length: 40 bytes of data
+	// fit a 1-byte varint, but the 82-byte and 84-byte levels need 2 bytes
+	data := bytes.Repeat([]byte{0xA0}, 40)
+	in := inner{Data: data}
+	value := outer{Middles: []middle{{Inners: []inner{in, in}}}}
+
+	innerEncoding := "28" + strings.Repeat("A0", 40)
+	encoding := unhex("4054" + "4052" + innerEncoding + innerEncoding)
+
+	out, err := Marshal(value)
+	require.Nil(t, err)
+	require.Equal(t, out, encoding)
+
+	// Strict decoding rejects any varint that is longer than necessary
+	var decoded outer
+	read, err := UnmarshalWithOptions(out, &decoded, DecodeOptions{Strict: true})
+	require.Nil(t, err)
+	require.Equal(t, read, len(out))
+	require.Equal(t, decoded, value)
+}
+
+func BenchmarkMarshalNested(b *testing.B) {
+	type inner struct {
+		A []uint16 `tls:"head=1"`
+		B []byte   `tls:"head=varint"`
+	}
+	type middle struct {
+		Inners []inner `tls:"head=2"`
+	}
+	type outer struct {
+		Middles []middle `tls:"head=varint"`
+	}
+
+	in := inner{A: []uint16{1, 2, 3}, B: []byte{4, 5, 6}}
+	mid := middle{Inners: []inner{in, in, in}}
+	value := outer{Middles: []middle{mid, mid, mid}}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i += 1 {
+		if _, err := Marshal(value); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package syntax
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// An enum is an unsigned integer type with a registered set of known values.
+// When a value of the type is decoded, values outside of the set are handled
+// according to the EnumMode registered for the type:
+//
+//	type ContentType uint8
+//
+//	func init() {
+//		RegisterEnum(ContentType(0), []uint{20, 21, 22, 23}, EnumClamp, 0)
+//	}
+//
+// Enums must be registered before the type is first decoded.
+
+// EnumMode specifies how unknown values of an enum are handled on decode.
+type EnumMode int
+
+const (
+	// EnumReject causes decoding to fail on an unknown value
+	EnumReject EnumMode = iota
+
+	// EnumPreserve stores an unknown value as-is
+	EnumPreserve
+
+	// EnumClamp replaces an unknown value with a sentinel value
+	EnumClamp
+)
+
+type enumInfo struct {
+	known    map[uint64]bool
+	mode     EnumMode
+	sentinel uint64
+}
+
+var (
+	enumMutex    sync.RWMutex
+	enumRegistry = map[reflect.Type]enumInfo{}
+)
+
+// RegisterEnum registers the known values of the type of `enum`, along with
+// the handling of unknown values.  The `unknown` value is stored in place of
+// unknown values when the mode is EnumClamp, and is ignored otherwise.
+func RegisterEnum(enum interface{}, known []uint, mode EnumMode, unknown uint) {
+	enumType := reflect.TypeOf(enum)
+	if !isUintKind(enumType.Kind()) {
+		panic(fmt.Errorf("Enum must be an unsigned integer type (%s)", enumType))
+	}
+
+	info := enumInfo{known: map[uint64]bool{}, mode: mode, sentinel: uint64(unknown)}
+	for _, val := range known {
+		info.known[uint64(val)] = true
+	}
+
+	enumMutex.Lock()
+	defer enumMutex.Unlock()
+	enumRegistry[enumType] = info
+}
+
+func lookupEnum(t reflect.Type) (enumInfo, bool) {
+	enumMutex.RLock()
+	defer enumMutex.RUnlock()
+
+	info, ok := enumRegistry[t]
+	return info, ok
+}
+
+//////////
+
+func newEnumDecoder(raw decoderFunc, info enumInfo) decoderFunc {
+	return func(d *decodeState, v reflect.Value, opts fieldOptions) int {
+		read := raw(d, v, opts)
+
+		val := v.Elem().Uint()
+		if info.known[val] {
+			return read
+		}
+
+		switch info.mode {
+		case EnumReject:
+			panic(fmt.Errorf("Unknown value for enum %s: %d", v.Elem().Type(), val))
+		case EnumClamp:
+			v.Elem().SetUint(info.sentinel)
+		}
+
+		return read
+	}
+}
@@ -0,0 +1,57 @@
+package syntax
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type enumTestReject uint8
+type enumTestPreserve uint8
+type enumTestClamp uint16
+
+func init() {
+	RegisterEnum(enumTestReject(0), []uint{1, 2}, EnumReject, 0)
+	RegisterEnum(enumTestPreserve(0), []uint{1, 2}, EnumPreserve, 0)
+	RegisterEnum(enumTestClamp(0), []uint{1, 2, 0xFFFF}, EnumClamp, 0xFFFF)
+}
+
+func TestEnum(t *testing.T) {
+	// Known values are accepted in all modes
+	var reject enumTestReject
+	_, err := Unmarshal(unhex("02"), &reject)
+	require.Nil(t, err)
+	require.Equal(t, reject, enumTestReject(2))
+
+	var preserve enumTestPreserve
+	_, err = Unmarshal(unhex("02"), &preserve)
+	require.Nil(t, err)
+	require.Equal(t, preserve, enumTestPreserve(2))
+
+	var clamp enumTestClamp
+	_, err = Unmarshal(unhex("0002"), &clamp)
+	require.Nil(t, err)
+	require.Equal(t, clamp, enumTestClamp(2))
+
+	// Unknown values are handled according to the mode
+	_, err = Unmarshal(unhex("03"), &reject)
+	require.NotNil(t, err)
+
+	read, err := Unmarshal(unhex("03"), &preserve)
+	require.Nil(t, err)
+	require.Equal(t, read, 1)
+	require.Equal(t, preserve, enumTestPreserve(3))
+
+	read, err = Unmarshal(unhex("0003"), &clamp)
+	require.Nil(t, err)
+	require.Equal(t, read, 2)
+	require.Equal(t, clamp, enumTestClamp(0xFFFF))
+
+	// The mode applies to enums nested in other types
+	var vector struct {
+		V []enumTestClamp `tls:"head=1"`
+	}
+	_, err = Unmarshal(unhex("04"+"0001"+"0005"), &vector)
+	require.Nil(t, err)
+	require.Equal(t, vector.V, []enumTestClamp{1, 0xFFFF})
+}
@@ -0,0 +1,80 @@
+package syntax
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// An error that occurs within a struct field, or within an element of a
+// vector or map, is reported as a *SyntaxError, which records the path from
+// the top-level value to the value that failed:
+//
+//	_, err := Unmarshal(data, &msg)
+//	if serr, ok := err.(*SyntaxError); ok {
+//		log.Printf("bad field %s: %v", serr.Path, serr.Err)
+//	}
+//
+// Paths are made of field names separated by dots, with the positions of
+// vector elements and map entries in brackets, e.g., "Outer.Items[3].Header".
+// Map entries are numbered in the order they are encoded, except that an
+// error in a map key on encode is reported with the key itself.  Errors returned by MarshalTLS, UnmarshalTLS, and
+// ValidForTLS methods are wrapped, so that they can be recovered with
+// errors.Is and errors.As.
+
+// SyntaxError describes an error encoding or decoding a value nested within
+// the value being marshaled or unmarshaled.
+type SyntaxError struct {
+	// Path identifies the value that failed, e.g., "Outer.Items[3].Header"
+	Path string
+
+	// Err is the underlying error
+	Err error
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax: field %s: %v", e.Path, e.Err)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// withPath prefixes the path of err with `prefix`, wrapping err in a
+// SyntaxError if it does not already have a path
+func withPath(prefix string, err error) error {
+	serr, ok := err.(*SyntaxError)
+	if !ok {
+		return &SyntaxError{Path: prefix, Err: err}
+	}
+
+	sep := "."
+	if strings.HasPrefix(serr.Path, "[") {
+		sep = ""
+	}
+	return &SyntaxError{Path: prefix + sep + serr.Path, Err: serr.Err}
+}
+
+// annotatePath adds `prefix` to the path of a recovered panic value, which is
+// then re-panicked.  Runtime errors and internal signals are passed through
+// unchanged.
+func annotatePath(r interface{}, prefix string) {
+	if err, ok := r.(error); ok && err != errEncodingDiffers {
+		if _, ok := r.(runtime.Error); !ok {
+			r = withPath(prefix, err)
+		}
+	}
+	panic(r)
+}
+
+func annotateElementError(i int) {
+	if r := recover(); r != nil {
+		annotatePath(r, fmt.Sprintf("[%d]", i))
+	}
+}
+
+func annotateFieldError(name string) {
+	if r := recover(); r != nil {
+		annotatePath(r, name)
+	}
+}
@@ -0,0 +1,107 @@
+package syntax
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var errBadHeader = errors.New("Bad header")
+
+// A checkedHeader is a single octet, with the value 0xFF reserved
+type checkedHeader uint8
+
+func (h checkedHeader) MarshalTLS() ([]byte, error) {
+	if h == 0xFF {
+		return nil, errBadHeader
+	}
+	return []byte{byte(h)}, nil
+}
+
+func (h *checkedHeader) UnmarshalTLS(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, errors.New("TLS data not long enough")
+	}
+	if data[0] == 0xFF {
+		return 0, errBadHeader
+	}
+	*h = checkedHeader(data[0])
+	return 1, nil
+}
+
+type pathItem struct {
+	Header checkedHeader
+	Body   []byte `tls:"head=1"`
+}
+
+type pathOuter struct {
+	Items []pathItem `tls:"head=1"`
+}
+
+type pathMessage struct {
+	Outer pathOuter
+	Tail  map[uint8]pathItem `tls:"head=1"`
+}
+
+func TestSyntaxErrorPath(t *testing.T) {
+	cases := map[string]struct {
+		encoding []byte
+		path     string
+		err      error
+	}{
+		"user-error": {
+			encoding: unhex("08" + "0100" + "0200" + "0300" + "FF00" + "00"),
+			path:     "Outer.Items[3].Header",
+			err:      errBadHeader,
+		},
+		"framing-error": {
+			encoding: unhex("06" + "0100" + "0200" + "0305"),
+			path:     "Outer.Items[2].Body",
+		},
+		"map-entry": {
+			encoding: unhex("00" + "06" + "010100" + "02FF00"),
+			path:     "Tail[1].Header",
+			err:      errBadHeader,
+		},
+	}
+
+	for label, testCase := range cases {
+		var decoded pathMessage
+		_, err := Unmarshal(testCase.encoding, &decoded)
+		require.NotNil(t, err, label)
+
+		var serr *SyntaxError
+		require.True(t, errors.As(err, &serr), label)
+		require.Equal(t, serr.Path, testCase.path, label)
+		require.Equal(t, err.Error(), "syntax: field "+serr.Path+": "+serr.Err.Error(), label)
+		if testCase.err != nil {
+			require.True(t, errors.Is(err, testCase.err), label)
+		}
+	}
+
+	// Encode errors carry the same paths
+	value := pathMessage{
+		Outer: pathOuter{Items: []pathItem{{Header: 1}, {Header: 0xFF}}},
+	}
+	_, err := Marshal(value)
+	require.NotNil(t, err)
+	require.Equal(t, err.(*SyntaxError).Path, "Outer.Items[1].Header")
+	require.True(t, errors.Is(err, errBadHeader))
+
+	// Map entries are numbered in sorted order, regardless of iteration order
+	value = pathMessage{
+		Tail: map[uint8]pathItem{3: {Header: 0xFF}, 1: {Header: 1}, 2: {Header: 2}, 4: {Header: 4}},
+	}
+	for i := 0; i < 10; i += 1 {
+		_, err = Marshal(value)
+		require.NotNil(t, err)
+		require.Equal(t, err.(*SyntaxError).Path, "Tail[2].Header")
+	}
+
+	// Errors in the top-level value have no path
+	_, err = Marshal(checkedHeader(0xFF))
+	require.NotNil(t, err)
+	_, ok := err.(*SyntaxError)
+	require.False(t, ok)
+}
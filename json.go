@@ -0,0 +1,142 @@
+package syntax
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strconv"
+)
+
+// ToJSON renders a value as JSON, for logging and debugging.  Unlike
+// encoding/json, it follows the structure the TLS codec sees: fields tagged
+// `omit` and group markers are skipped, byte strings render as hex, and nil
+// pointers render as null.  The rendering can be adjusted with JSONOptions,
+// e.g., to show identifiers as they appear in specifications and packet
+// captures:
+//
+//	type CipherSuite uint16
+//
+//	out, err := ToJSON(hello, JSONOptions{HexTypes: []interface{}{CipherSuite(0)}})
+//
+// ToJSON is for diagnostics only; its output cannot be decoded.
+
+// JSONOptions controls how ToJSON renders values.
+type JSONOptions struct {
+	// HexTypes lists unsigned integer types, by example values, whose values
+	// are rendered as hex strings, e.g., "0x1301"
+	HexTypes []interface{}
+
+	// HexAll renders all unsigned integers of 16 bits or more as hex strings
+	HexAll bool
+}
+
+func (opts JSONOptions) hex(t reflect.Type) bool {
+	if opts.HexAll && t.Size() >= 2 {
+		return true
+	}
+
+	for _, h := range opts.HexTypes {
+		if reflect.TypeOf(h) == t {
+			return true
+		}
+	}
+	return false
+}
+
+// ToJSON returns a JSON rendering of v.
+func ToJSON(v interface{}, opts JSONOptions) (out []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+			if s, ok := r.(string); ok {
+				panic(s)
+			}
+			err = r.(error)
+		}
+	}()
+
+	buf := &bytes.Buffer{}
+	writeJSON(buf, reflect.ValueOf(v), opts)
+	return buf.Bytes(), nil
+}
+
+//////////
+
+func writeJSON(buf *bytes.Buffer, v reflect.Value, opts JSONOptions) {
+	if !v.IsValid() {
+		buf.WriteString("null")
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			buf.WriteString("null")
+			return
+		}
+		writeJSON(buf, v.Elem(), opts)
+
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if opts.hex(v.Type()) {
+			fmt.Fprintf(buf, `"0x%0*x"`, 2*int(v.Type().Size()), v.Uint())
+			return
+		}
+		buf.WriteString(strconv.FormatUint(v.Uint(), 10))
+
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 && !opts.hex(v.Type().Elem()) {
+			// Render byte strings as hex, rather than as a list of numbers
+			data := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(data), v)
+			fmt.Fprintf(buf, `"%x"`, data)
+			return
+		}
+
+		buf.WriteByte('[')
+		for i := 0; i < v.Len(); i += 1 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSON(buf, v.Index(i), opts)
+		}
+		buf.WriteByte(']')
+
+	case reflect.Struct:
+		t := v.Type()
+		buf.WriteByte('{')
+		first := true
+		for i := 0; i < t.NumField(); i += 1 {
+			f := t.Field(i)
+			fieldOpts := parseTag(f.Tag.Get("tls"))
+			if f.PkgPath != "" || fieldOpts.omit || fieldOpts.groupHeaderSize > 0 || fieldOpts.groupEnd {
+				continue
+			}
+
+			if !first {
+				buf.WriteByte(',')
+			}
+			first = false
+
+			writeJSONLeaf(buf, reflect.ValueOf(f.Name))
+			buf.WriteByte(':')
+			writeJSON(buf, v.Field(i), opts)
+		}
+		buf.WriteByte('}')
+
+	default:
+		writeJSONLeaf(buf, v)
+	}
+}
+
+// writeJSONLeaf renders a value that needs no special handling
+func writeJSONLeaf(buf *bytes.Buffer, v reflect.Value) {
+	data, err := json.Marshal(v.Interface())
+	if err != nil {
+		panic(err)
+	}
+	buf.Write(data)
+}
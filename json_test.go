@@ -0,0 +1,39 @@
+package syntax
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type jsonTestID uint32
+
+type jsonTest struct {
+	Type   uint16
+	ID     jsonTestID
+	Body   []byte `tls:"head=1"`
+	Hidden uint8  `tls:"omit"`
+	Next   *uint8 `tls:"optional"`
+	List   []uint8
+	Name   string
+}
+
+func TestToJSON(t *testing.T) {
+	value := jsonTest{Type: 0x0102, ID: 0xA0, Body: []byte{0xB0, 0xB1}, Hidden: 1, List: []uint8{1, 2}, Name: "x"}
+
+	out, err := ToJSON(value, JSONOptions{})
+	require.Nil(t, err)
+	require.Equal(t, string(out), `{"Type":258,"ID":160,"Body":"b0b1","Next":null,"List":"0102","Name":"x"}`)
+
+	out, err = ToJSON(value, JSONOptions{HexTypes: []interface{}{jsonTestID(0)}})
+	require.Nil(t, err)
+	require.Equal(t, string(out), `{"Type":258,"ID":"0x000000a0","Body":"b0b1","Next":null,"List":"0102","Name":"x"}`)
+
+	out, err = ToJSON(value, JSONOptions{HexAll: true})
+	require.Nil(t, err)
+	require.Equal(t, string(out), `{"Type":"0x0102","ID":"0x000000a0","Body":"b0b1","Next":null,"List":"0102","Name":"x"}`)
+
+	// Unsupported values
+	_, err = ToJSON(struct{ F func() }{}, JSONOptions{})
+	require.NotNil(t, err)
+}
@@ -0,0 +1,89 @@
+package syntax
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Lazy holds the body of a vector whose contents are only decoded on demand.
+// On decode, a Lazy field captures the raw bytes delimited by its header.
+// On encode, it writes either those bytes, or the encoding of a value set
+// with Set.
+//
+//	type Message struct {
+//		Type uint8
+//		Body Lazy `tls:"head=2"`
+//	}
+type Lazy struct {
+	raw   []byte
+	value interface{}
+}
+
+var lazyType = reflect.TypeOf(Lazy{})
+
+// NewLazy returns a Lazy that will encode the specified value.
+func NewLazy(v interface{}) Lazy {
+	return Lazy{value: v}
+}
+
+// Set replaces the contents of the Lazy with a value to be encoded.
+func (l *Lazy) Set(v interface{}) {
+	l.raw = nil
+	l.value = v
+}
+
+// Bytes returns the encoded contents of the Lazy.
+func (l Lazy) Bytes() ([]byte, error) {
+	if l.value == nil {
+		return l.raw, nil
+	}
+	return Marshal(l.value)
+}
+
+// Decode parses the contents of the Lazy into v, which must consume them
+// entirely.
+func (l Lazy) Decode(v interface{}) error {
+	data, err := l.Bytes()
+	if err != nil {
+		return err
+	}
+
+	read, err := Unmarshal(data, v)
+	if err != nil {
+		return err
+	}
+
+	if read != len(data) {
+		return fmt.Errorf("Lazy value not fully consumed [%d < %d]", read, len(data))
+	}
+	return nil
+}
+
+//////////
+
+func lazyEncoder(e *encodeState, v reflect.Value, opts fieldOptions) {
+	l := v.Interface().(Lazy)
+
+	encodeVector(e, opts, func(e *encodeState) {
+		if l.value == nil {
+			e.Write(l.raw)
+			return
+		}
+
+		e.reflectValue(reflect.ValueOf(l.value), fieldOptions{})
+	})
+}
+
+func lazyDecoder(d *decodeState, v reflect.Value, opts fieldOptions) int {
+	read, length := decodeLength(d, opts)
+
+	data := d.Next(length)
+	if len(data) != length {
+		panic(fmt.Errorf("Not enough data to read lazy value"))
+	}
+
+	d.allocate(length)
+	v.Interface().(*Lazy).raw = d.allocBytes(data)
+	v.Interface().(*Lazy).value = nil
+	return read + length
+}
@@ -0,0 +1,68 @@
+package syntax
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type lazyTestMessage struct {
+	Type uint8
+	Body Lazy `tls:"head=2"`
+}
+
+func TestLazy(t *testing.T) {
+	encoding := unhex("01" + "0009" + "000a0005f0f1f2f3f4")
+
+	// Encode from a value
+	message := lazyTestMessage{Type: 0x01, Body: NewLazy(extValidIn)}
+	out, err := Marshal(message)
+	require.Nil(t, err)
+	require.Equal(t, out, encoding)
+
+	// Decode without parsing the body
+	var decoded lazyTestMessage
+	read, err := Unmarshal(encoding, &decoded)
+	require.Nil(t, err)
+	require.Equal(t, read, len(encoding))
+
+	raw, err := decoded.Body.Bytes()
+	require.Nil(t, err)
+	require.Equal(t, raw, encoding[3:])
+
+	// Re-encode from the raw bytes
+	out, err = Marshal(decoded)
+	require.Nil(t, err)
+	require.Equal(t, out, encoding)
+
+	// Parse the body on demand
+	var ext Extension
+	err = decoded.Body.Decode(&ext)
+	require.Nil(t, err)
+	require.Equal(t, ext, extValidIn)
+
+	// Parsing into a type that does not consume the whole body fails
+	var extType ExtensionType
+	err = decoded.Body.Decode(&extType)
+	require.NotNil(t, err)
+
+	// Replace the body with a new value
+	decoded.Body.Set(uint16(0xB0A0))
+	out, err = Marshal(decoded)
+	require.Nil(t, err)
+	require.Equal(t, out, unhex("01"+"0002"+"B0A0"))
+}
+
+func TestLazyErrors(t *testing.T) {
+	var decoded lazyTestMessage
+	_, err := Unmarshal(unhex("01"+"0009"+"000a"), &decoded)
+	require.NotNil(t, err)
+
+	_, err = Marshal(lazyTestMessage{Body: NewLazy(float64(0))})
+	require.NotNil(t, err)
+
+	_, err = Marshal(struct {
+		Body Lazy
+	}{Body: NewLazy(uint8(0))})
+	require.NotNil(t, err)
+}
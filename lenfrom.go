@@ -0,0 +1,141 @@
+package syntax
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// A vector tagged with `len-from=Field` has no length header of its own.
+// Instead, its length is held in the earlier unsigned integer field Field,
+// with any number of fields in between, as in a TLS record:
+//
+//	type TLSPlaintext struct {
+//		Type     uint8
+//		Version  uint16
+//		Length   uint16
+//		Fragment []byte `tls:"len-from=Length"`
+//	}
+//
+// On encode, the length field is filled in with the length of the encoded
+// vector, regardless of its value.  Since it is filled in as a fixed-width
+// integer, the length field cannot be a varint, be omitted, or have a custom
+// encoding.  On decode, the vector must consume exactly the number of bytes
+// that the length field indicates.
+//
+// Similarly, a vector tagged with `head=auto,width-from=Field` has a
+// fixed-width length header, whose width in bytes is held in the earlier
+// unsigned integer field Field:
+//
+//	type Entry struct {
+//		Width uint8
+//		Data  []byte `tls:"head=auto,width-from=Width"`
+//	}
+//
+// On encode, the header is the narrowest that holds the length of the
+// vector, from one to eight bytes, and the width field is filled in with its
+// width.  On decode, a header wider than necessary is non-canonical.  Since
+// the width of the header is not carried on the wire, `head=auto` without
+// `width-from` is rejected.
+
+// lengthFromIndex returns the index of the length field for field i of the
+// struct type t, or -1 if the field does not take its length from another.
+func lengthFromIndex(t reflect.Type, i int, opts fieldOptions) int {
+	if opts.lengthFrom == "" {
+		return -1
+	}
+	return backfilledIndex(t, i, "Length", opts.lengthFrom)
+}
+
+// widthFromIndex returns the index of the width field for field i of the
+// struct type t, or -1 if the field's header width is not held in another.
+func widthFromIndex(t reflect.Type, i int, opts fieldOptions) int {
+	if opts.widthFrom == "" {
+		return -1
+	}
+	return backfilledIndex(t, i, "Width", opts.widthFrom)
+}
+
+// backfilledIndex returns the index of the field `name` of the struct type
+// t, which holds a property of field i, verifying that it is an earlier
+// fixed-width unsigned integer that can be filled in once field i is encoded
+func backfilledIndex(t reflect.Type, i int, role, name string) int {
+	f, ok := t.FieldByName(name)
+	if !ok || len(f.Index) != 1 || f.Index[0] >= i {
+		panic(fmt.Errorf("%s field %s must be an earlier field", role, name))
+	}
+
+	if !isUintKind(f.Type.Kind()) {
+		panic(fmt.Errorf("%s field %s must be an unsigned integer", role, name))
+	}
+
+	fieldOpts := parseTag(f.Tag.Get("tls"))
+	if fieldOpts.varint || fieldOpts.omit || f.Type.Implements(marshalerType) ||
+		reflect.PtrTo(f.Type).Implements(unmarshalerType) {
+		panic(fmt.Errorf("%s field %s must be a fixed-width integer", role, name))
+	}
+
+	return f.Index[0]
+}
+
+// lengthFromDecoder decodes a vector whose length has already been decoded
+// into the field `length`
+func lengthFromDecoder(d *decodeState, v, length reflect.Value, dec decoderFunc, opts fieldOptions) int {
+	n := int(length.Uint())
+	if n < 0 || uint64(n) != length.Uint() {
+		panic(fmt.Errorf("Vector length too large [%d]", length.Uint()))
+	}
+
+	data := d.Next(n)
+	if len(data) != n {
+		panic(fmt.Errorf("Not enough data to read vector [%d > %d]", n, len(data)))
+	}
+
+	read := dec(d.sub(data), v, opts)
+	if read != n {
+		panic(fmt.Errorf("Vector not fully consumed [%d < %d]", read, n))
+	}
+	return read
+}
+
+// minimalWidth returns the number of bytes needed to hold n, at least one
+func minimalWidth(n uint64) int {
+	width := 1
+	for width < 8 && n>>uint(8*width) > 0 {
+		width += 1
+	}
+	return width
+}
+
+// insertAutoHeader inserts a header of the narrowest width that holds the
+// length of the vector encoded since `start`, returning the width
+func insertAutoHeader(e *encodeState, start int, opts fieldOptions) int {
+	n := e.Len() - start
+	width := minimalWidth(uint64(n))
+	for i := 0; i < width; i += 1 {
+		e.Buffer.WriteByte(0)
+	}
+
+	buf := e.Bytes()[start:]
+	copy(buf[width:], buf[:len(buf)-width])
+	putUint(buf[:width], uint64(n), opts.byteOrder(e.opts.ByteOrder))
+	return width
+}
+
+// widthFromDecoder decodes a vector whose header width has already been
+// decoded into the field `width`
+func widthFromDecoder(d *decodeState, v, width reflect.Value, dec decoderFunc, opts fieldOptions) int {
+	w := width.Uint()
+	if w < 1 || w > uint64(maxHeaderSize) {
+		panic(fmt.Errorf("Invalid header width [%d]", w))
+	}
+	opts.headerSize = int(w)
+
+	if header := d.peek(opts.headerSize); header != nil {
+		n := decodeUintWithOrder(header, opts.byteOrder(d.opts.ByteOrder))
+		if minimalWidth(n) != opts.headerSize {
+			d.nonCanonical(d.offset(), "Header wider than necessary [%d > %d]", w, minimalWidth(n))
+		}
+	}
+
+	return dec(d, v, opts)
+}
@@ -0,0 +1,168 @@
+package syntax
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type lengthFromRecord struct {
+	Type     uint8
+	Version  uint16
+	Length   uint16
+	Fragment []byte `tls:"len-from=Length"`
+}
+
+func TestLengthFrom(t *testing.T) {
+	value := lengthFromRecord{Type: 0x17, Version: 0x0303, Fragment: []byte{0xA0, 0xA1, 0xA2}}
+	encoding := unhex("17" + "0303" + "0003" + "A0A1A2")
+
+	// The length is filled in, regardless of the value of the length field
+	out, err := Marshal(value)
+	require.Nil(t, err)
+	require.Equal(t, out, encoding)
+
+	var decoded lengthFromRecord
+	read, err := Unmarshal(append(out, 0xFF), &decoded)
+	require.Nil(t, err)
+	require.Equal(t, read, len(encoding))
+	require.Equal(t, decoded.Length, uint16(3))
+	require.Equal(t, decoded.Fragment, value.Fragment)
+
+	// Vectors of other types and strings take their length in bytes
+	type elements struct {
+		Count uint8
+		Skip  uint8
+		Elems []uint16 `tls:"len-from=Count"`
+		Size  uint8
+		Name  string `tls:"len-from=Size"`
+	}
+	elementsValue := elements{Skip: 0xB0, Elems: []uint16{0xC0C1, 0xC2C3}, Name: "ab"}
+	elementsEncoding := unhex("04" + "B0" + "C0C1C2C3" + "02" + "6162")
+
+	out, err = Marshal(elementsValue)
+	require.Nil(t, err)
+	require.Equal(t, out, elementsEncoding)
+
+	var decodedElements elements
+	read, err = Unmarshal(out, &decodedElements)
+	require.Nil(t, err)
+	require.Equal(t, read, len(out))
+	require.Equal(t, decodedElements.Elems, elementsValue.Elems)
+	require.Equal(t, decodedElements.Name, elementsValue.Name)
+}
+
+func TestLengthFromErrors(t *testing.T) {
+	// Not enough data for the indicated length
+	var decoded lengthFromRecord
+	_, err := Unmarshal(unhex("17"+"0303"+"0004"+"A0A1A2"), &decoded)
+	require.NotNil(t, err)
+
+	// Length too large for the length field
+	_, err = Marshal(struct {
+		Length uint8
+		Data   []byte `tls:"len-from=Length"`
+	}{Data: make([]byte, 256)})
+	require.NotNil(t, err)
+
+	// Partial element within the indicated length
+	var elements struct {
+		Length uint8
+		Elems  []uint16 `tls:"len-from=Length"`
+	}
+	_, err = Unmarshal(unhex("03"+"A0A1A2"), &elements)
+	require.NotNil(t, err)
+
+	// Length field must precede the vector
+	_, err = Marshal(struct {
+		Data   []byte `tls:"len-from=Length"`
+		Length uint8
+	}{})
+	require.NotNil(t, err)
+
+	// Length field must be encoded as a fixed-width integer
+	type varintLength struct {
+		Length uint16 `tls:"varint"`
+		Data   []byte `tls:"len-from=Length"`
+	}
+	_, err = Marshal(varintLength{Data: []byte{0x01, 0x02, 0x03}})
+	require.NotNil(t, err)
+
+	var decodedVarint varintLength
+	_, err = Unmarshal(unhex("0003010203"), &decodedVarint)
+	require.NotNil(t, err)
+
+	// Length field must not be shared
+	_, err = Marshal(struct {
+		Length uint8
+		A      []byte `tls:"len-from=Length"`
+		B      []byte `tls:"len-from=Length"`
+	}{})
+	require.NotNil(t, err)
+}
+
+func TestWidthFrom(t *testing.T) {
+	type autoHeader struct {
+		Width uint8
+		Data  []byte `tls:"head=auto,width-from=Width"`
+	}
+
+	cases := map[string]struct {
+		value    autoHeader
+		encoding []byte
+	}{
+		"short": {
+			value:    autoHeader{Data: []byte{0xA0, 0xA1, 0xA2}},
+			encoding: unhex("01" + "03" + "A0A1A2"),
+		},
+		"long": {
+			value:    autoHeader{Data: make([]byte, 0x100)},
+			encoding: append(unhex("02"+"0100"), make([]byte, 0x100)...),
+		},
+	}
+
+	for label, testCase := range cases {
+		out, err := Marshal(testCase.value)
+		require.Nil(t, err, label)
+		require.Equal(t, out, testCase.encoding, label)
+
+		var decoded autoHeader
+		read, err := UnmarshalWithOptions(out, &decoded, DecodeOptions{Strict: true})
+		require.Nil(t, err, label)
+		require.Equal(t, read, len(out), label)
+		require.Equal(t, decoded.Width, testCase.encoding[0], label)
+		require.Equal(t, decoded.Data, testCase.value.Data, label)
+	}
+
+	// Headers wider than necessary are only accepted in lenient mode
+	wide := unhex("02" + "0003" + "A0A1A2")
+	var decoded autoHeader
+	_, err := UnmarshalWithOptions(wide, &decoded, DecodeOptions{Strict: true})
+	require.NotNil(t, err)
+
+	read, err := Unmarshal(wide, &decoded)
+	require.Nil(t, err)
+	require.Equal(t, read, len(wide))
+	require.Equal(t, decoded.Data, []byte{0xA0, 0xA1, 0xA2})
+
+	// Widths outside 1..8 are rejected
+	for _, width := range []string{"00", "09"} {
+		_, err = Unmarshal(unhex(width+"03"+"A0A1A2"), &decoded)
+		require.NotNil(t, err, width)
+	}
+
+	// The width field must be set by head=auto
+	_, err = Marshal(struct {
+		Width uint8
+		Data  []byte `tls:"head=varint,width-from=Width"`
+	}{})
+	require.NotNil(t, err)
+
+	// An automatic header without a width field is rejected
+	_, err = Marshal(struct {
+		Data []byte `tls:"head=auto"`
+	}{})
+	require.NotNil(t, err)
+	require.True(t, strings.Contains(err.Error(), "width-from"), err.Error())
+}
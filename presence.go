@@ -0,0 +1,81 @@
+package syntax
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// A flag-gated field is a pointer whose presence is indicated by a bit in an
+// earlier integer field in the same struct, rather than by a presence octet:
+//
+//	type Message struct {
+//		Flags uint16
+//		Extra *ExtraBlock `tls:"present-if-bit=Flags:3"`
+//	}
+//
+// The field is decoded only if the bit is set, and is nil otherwise.  On
+// encode, the bit is set or cleared according to whether the field is nil,
+// regardless of the value of the flags field.  Bits are numbered from the
+// least significant bit, starting at zero.
+
+// parsePresenceBit parses the value of a `present-if-bit` tag
+func parsePresenceBit(val string) (string, int) {
+	parts := strings.Split(val, ":")
+	if len(parts) != 2 || len(parts[0]) == 0 {
+		panic(fmt.Errorf("Malformed presence bit: %s", val))
+	}
+
+	bit, err := strconv.Atoi(parts[1])
+	if err != nil || bit < 0 || bit > 63 {
+		panic(fmt.Errorf("Invalid presence bit: %s", parts[1]))
+	}
+	return parts[0], bit
+}
+
+// presenceIndex returns the index of the flags field for field i of the
+// struct type t, or -1 if the field is not flag-gated.
+func presenceIndex(t reflect.Type, i int, opts fieldOptions) int {
+	if opts.presenceField == "" {
+		return -1
+	}
+
+	f, ok := t.FieldByName(opts.presenceField)
+	if !ok || len(f.Index) != 1 || f.Index[0] >= i {
+		panic(fmt.Errorf("Flags field %s must be an earlier field", opts.presenceField))
+	}
+
+	if !isUintKind(f.Type.Kind()) {
+		panic(fmt.Errorf("Flags field %s must be an unsigned integer", opts.presenceField))
+	}
+
+	if opts.presenceBit >= 8*int(f.Type.Size()) {
+		panic(fmt.Errorf("Presence bit %d out of range for flags field %s", opts.presenceBit, opts.presenceField))
+	}
+
+	return f.Index[0]
+}
+
+// presenceFlags returns a copy of the flags field with the bits for each of
+// the gated fields set according to whether the field is present
+func presenceFlags(flags, v reflect.Value, gated []int, fieldOpts []fieldOptions) reflect.Value {
+	val := flags.Uint()
+	for _, i := range gated {
+		mask := uint64(1) << uint(fieldOpts[i].presenceBit)
+		if v.Field(i).IsNil() {
+			val &^= mask
+		} else {
+			val |= mask
+		}
+	}
+
+	out := reflect.New(flags.Type()).Elem()
+	out.SetUint(val)
+	return out
+}
+
+// presenceBitSet reports whether the presence bit for a field is set
+func presenceBitSet(flags reflect.Value, opts fieldOptions) bool {
+	return flags.Uint()&(uint64(1)<<uint(opts.presenceBit)) != 0
+}
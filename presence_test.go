@@ -0,0 +1,89 @@
+package syntax
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type presenceTest struct {
+	Flags uint8
+	A     *uint16 `tls:"present-if-bit=Flags:0"`
+	B     *uint8  `tls:"present-if-bit=Flags:3"`
+	C     uint8
+}
+
+func TestPresenceBit(t *testing.T) {
+	a, b := uint16(0xA0A1), uint8(0xB0)
+	cases := map[string]struct {
+		value    presenceTest
+		encoding []byte
+	}{
+		"none": {
+			value:    presenceTest{C: 0xC0},
+			encoding: unhex("00" + "C0"),
+		},
+		"first": {
+			value:    presenceTest{A: &a, C: 0xC0},
+			encoding: unhex("01" + "A0A1" + "C0"),
+		},
+		"both": {
+			value:    presenceTest{Flags: 0xF0, A: &a, B: &b, C: 0xC0},
+			encoding: unhex("F9" + "A0A1" + "B0" + "C0"),
+		},
+	}
+
+	for label, testCase := range cases {
+		encoding, err := Marshal(testCase.value)
+		require.Nil(t, err, label)
+		require.Equal(t, encoding, testCase.encoding, label)
+
+		var decoded presenceTest
+		read, err := Unmarshal(encoding, &decoded)
+		require.Nil(t, err, label)
+		require.Equal(t, read, len(encoding), label)
+		require.Equal(t, decoded.A, testCase.value.A, label)
+		require.Equal(t, decoded.B, testCase.value.B, label)
+		require.Equal(t, decoded.C, testCase.value.C, label)
+	}
+
+	// Bits are cleared for nil fields, regardless of the flags value
+	encoding, err := Marshal(presenceTest{Flags: 0x09, C: 0xC0})
+	require.Nil(t, err)
+	require.Equal(t, encoding, unhex("00"+"C0"))
+}
+
+func TestPresenceBitErrors(t *testing.T) {
+	// Flags field must precede the gated field
+	_, err := Marshal(struct {
+		A     *uint8 `tls:"present-if-bit=Flags:0"`
+		Flags uint8
+	}{})
+	require.NotNil(t, err)
+
+	// Flags field must be an unsigned integer
+	_, err = Marshal(struct {
+		Flags []byte `tls:"head=1"`
+		A     *uint8 `tls:"present-if-bit=Flags:0"`
+	}{})
+	require.NotNil(t, err)
+
+	// Bit must fit in the flags field
+	_, err = Marshal(struct {
+		Flags uint8
+		A     *uint8 `tls:"present-if-bit=Flags:8"`
+	}{})
+	require.NotNil(t, err)
+
+	// Gated field must be a pointer
+	_, err = Marshal(struct {
+		Flags uint8
+		A     uint8 `tls:"present-if-bit=Flags:0"`
+	}{})
+	require.NotNil(t, err)
+
+	// Truncated gated field
+	var decoded presenceTest
+	_, err = Unmarshal(unhex("01"+"A0"), &decoded)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,169 @@
+package syntax
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+)
+
+// A schema describes the layout of a message without a Go type, as a list
+// of FieldLayouts.  UnmarshalSchema uses a schema to decode a message into a
+// generic tree of Nodes, for tools that need to inspect messages whose
+// types are not known at compile time.
+//
+//	schema := []FieldLayout{
+//		{Name: "Type", Kind: LayoutUint, Size: 1},
+//		{Name: "Body", Kind: LayoutOpaque, Tag: "head=2"},
+//	}
+
+// LayoutKind identifies how a field described by a FieldLayout is encoded.
+type LayoutKind int
+
+const (
+	// LayoutUint is an integer of Size bytes, or a varint
+	LayoutUint LayoutKind = iota
+
+	// LayoutOpaque is a vector of bytes
+	LayoutOpaque
+
+	// LayoutVector is a vector of elements, each laid out as Fields
+	LayoutVector
+
+	// LayoutStruct is a sequence of fields laid out as Fields
+	LayoutStruct
+)
+
+// FieldLayout describes one field in a schema.  Tag holds the same
+// annotations that would appear in the `tls` tag of a struct field.
+type FieldLayout struct {
+	Name   string
+	Kind   LayoutKind
+	Size   int
+	Tag    string
+	Fields []FieldLayout
+}
+
+// Node is a decoded field.  Value is set for LayoutUint fields, and Data for
+// LayoutOpaque fields.  The Children of a LayoutStruct node are its fields;
+// those of a LayoutVector node are its elements, each of which is a node
+// with the element's fields as children.
+type Node struct {
+	Name     string
+	Value    uint64
+	Data     []byte
+	Children []*Node
+}
+
+// UnmarshalSchema decodes data according to the schema, returning a node
+// whose children are the fields of the schema, along with the number of
+// bytes read.
+func UnmarshalSchema(data []byte, schema []FieldLayout) (node *Node, read int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+			if s, ok := r.(string); ok {
+				panic(s)
+			}
+			err = r.(error)
+		}
+	}()
+
+	d := newDecodeState(data, DecodeOptions{})
+	node, read = decodeLayoutFields(d, schema)
+	return node, read, nil
+}
+
+//////////
+
+var uint64Type = reflect.TypeOf(uint64(0))
+
+func decodeLayoutFields(d *decodeState, fields []FieldLayout) (*Node, int) {
+	node := &Node{Children: make([]*Node, len(fields))}
+	read := 0
+	for i, layout := range fields {
+		var fieldRead int
+		node.Children[i], fieldRead = decodeLayout(d, layout)
+		read += fieldRead
+	}
+	return node, read
+}
+
+func decodeLayout(d *decodeState, layout FieldLayout) (*Node, int) {
+	defer annotateFieldError(layout.Name)
+
+	opts := parseTag(layout.Tag)
+
+	var node *Node
+	var read int
+	switch layout.Kind {
+	case LayoutUint:
+		node, read = decodeLayoutUint(d, layout, opts)
+
+	case LayoutOpaque:
+		var length int
+		read, length = decodeLength(d, opts)
+
+		data := d.Next(length)
+		if len(data) != length {
+			panic(fmt.Errorf("Not enough data to read elements"))
+		}
+
+		d.allocate(length)
+		node = &Node{Data: append([]byte{}, data...)}
+		read += length
+
+	case LayoutVector:
+		var length int
+		read, length = decodeLength(d, opts)
+
+		elemData := d.Next(length)
+		if len(elemData) != length {
+			panic(fmt.Errorf("Not enough data to read elements"))
+		}
+
+		elemBuf := d.sub(elemData)
+		node = &Node{}
+		for i := 0; elemBuf.Len() > 0; i += 1 {
+			elem := decodeLayoutElement(elemBuf, layout.Fields, i)
+			node.Children = append(node.Children, elem)
+		}
+
+		read += length
+
+	case LayoutStruct:
+		node, read = decodeLayoutFields(d, layout.Fields)
+
+	default:
+		panic(fmt.Errorf("Unknown layout kind: %d", layout.Kind))
+	}
+
+	node.Name = layout.Name
+	return node, read
+}
+
+func decodeLayoutUint(d *decodeState, layout FieldLayout, opts fieldOptions) (*Node, int) {
+	if opts.varint {
+		val := reflect.New(uint64Type)
+		read := varintDecoder(d, val, opts)
+		return &Node{Value: val.Elem().Uint()}, read
+	}
+
+	if layout.Size < 1 || layout.Size > 8 {
+		panic(fmt.Errorf("Invalid uint size: %d", layout.Size))
+	}
+
+	buf := d.Next(layout.Size)
+	if len(buf) != layout.Size {
+		panic(fmt.Errorf("Insufficient data to read uint"))
+	}
+
+	return &Node{Value: decodeUintWithOrder(buf, opts.byteOrder(d.opts.ByteOrder))}, layout.Size
+}
+
+func decodeLayoutElement(d *decodeState, fields []FieldLayout, i int) *Node {
+	defer annotateElementError(i)
+	node, _ := decodeLayoutFields(d, fields)
+	return node
+}
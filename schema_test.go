@@ -0,0 +1,79 @@
+package syntax
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var schemaTestLayout = []FieldLayout{
+	{Name: "Type", Kind: LayoutUint, Size: 2},
+	{Name: "Length", Kind: LayoutUint, Tag: "varint"},
+	{Name: "Entries", Kind: LayoutVector, Tag: "head=1", Fields: []FieldLayout{
+		{Name: "ID", Kind: LayoutUint, Size: 1},
+		{Name: "Data", Kind: LayoutOpaque, Tag: "head=1"},
+	}},
+	{Name: "Trailer", Kind: LayoutStruct, Fields: []FieldLayout{
+		{Name: "Flags", Kind: LayoutUint, Size: 3},
+	}},
+}
+
+func TestUnmarshalSchema(t *testing.T) {
+	encoding := unhex("000a" + "4123" + "06" + "0102A0A1" + "0200" + "010203")
+
+	node, read, err := UnmarshalSchema(encoding, schemaTestLayout)
+	require.Nil(t, err)
+	require.Equal(t, read, len(encoding))
+	require.Equal(t, node, &Node{
+		Children: []*Node{
+			{Name: "Type", Value: 0x000a},
+			{Name: "Length", Value: 0x0123},
+			{Name: "Entries", Children: []*Node{
+				{Children: []*Node{
+					{Name: "ID", Value: 0x01},
+					{Name: "Data", Data: []byte{0xA0, 0xA1}},
+				}},
+				{Children: []*Node{
+					{Name: "ID", Value: 0x02},
+					{Name: "Data", Data: []byte{}},
+				}},
+			}},
+			{Name: "Trailer", Children: []*Node{
+				{Name: "Flags", Value: 0x010203},
+			}},
+		},
+	})
+}
+
+func TestUnmarshalSchemaErrors(t *testing.T) {
+	cases := map[string]struct {
+		schema   []FieldLayout
+		encoding []byte
+	}{
+		"short-uint": {
+			schema:   schemaTestLayout,
+			encoding: unhex("00"),
+		},
+		"element-overrun": {
+			schema:   schemaTestLayout,
+			encoding: unhex("000a" + "4123" + "03" + "0102A0"),
+		},
+		"no-header": {
+			schema:   []FieldLayout{{Name: "Data", Kind: LayoutOpaque}},
+			encoding: unhex("00"),
+		},
+		"bad-size": {
+			schema:   []FieldLayout{{Name: "Value", Kind: LayoutUint, Size: 9}},
+			encoding: unhex("000000000000000000"),
+		},
+		"bad-kind": {
+			schema:   []FieldLayout{{Name: "Value", Kind: LayoutKind(99)}},
+			encoding: unhex("00"),
+		},
+	}
+
+	for label, testCase := range cases {
+		_, _, err := UnmarshalSchema(testCase.encoding, testCase.schema)
+		require.NotNil(t, err, label)
+	}
+}
@@ -0,0 +1,178 @@
+package syntax
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// A select field holds one of several types, determined by the value of an
+// earlier integer field in the same struct (the selector):
+//
+//	type Message struct {
+//		Type MessageType `tls:"varint"`
+//		Body interface{} `tls:"select=Type"`
+//	}
+//
+// The variant types for each selector value are registered with
+// RegisterVariant.  A selector value can also be registered with
+// RegisterAbsentVariant to indicate that no body follows, in which case the
+// select field is nil.  The registry is keyed on the numeric value of the
+// selector, so the selector can use any integer encoding.
+
+type variantKey struct {
+	selector reflect.Type
+	value    uint64
+}
+
+var (
+	variantMutex    sync.RWMutex
+	variantRegistry = map[variantKey]func() interface{}{}
+	absentRegistry  = map[reflect.Type]uint64{}
+)
+
+// RegisterVariant registers the type to be used for a select field when
+// the selector field has the type of `selector` and the indicated value.
+// The factory must return a pointer to a new value of the variant type.
+func RegisterVariant(selector interface{}, value uint, factory func() interface{}) {
+	selectorType := reflect.TypeOf(selector)
+	if !isUintKind(selectorType.Kind()) {
+		panic(fmt.Errorf("Variant selector must be an unsigned integer type (%s)", selectorType))
+	}
+
+	if reflect.TypeOf(factory()).Kind() != reflect.Ptr {
+		panic(fmt.Errorf("Variant factory must return a pointer"))
+	}
+
+	variantMutex.Lock()
+	defer variantMutex.Unlock()
+	variantRegistry[variantKey{selectorType, uint64(value)}] = factory
+}
+
+// RegisterAbsentVariant registers the value of a selector of the type of
+// `selector` that indicates that the select field is absent.  A nil select
+// field is encoded by writing this value for the selector and no body.
+func RegisterAbsentVariant(selector interface{}, value uint) {
+	selectorType := reflect.TypeOf(selector)
+	if !isUintKind(selectorType.Kind()) {
+		panic(fmt.Errorf("Variant selector must be an unsigned integer type (%s)", selectorType))
+	}
+
+	variantMutex.Lock()
+	defer variantMutex.Unlock()
+	absentRegistry[selectorType] = uint64(value)
+}
+
+func lookupAbsentVariant(selectorType reflect.Type) (uint64, bool) {
+	variantMutex.RLock()
+	defer variantMutex.RUnlock()
+
+	value, ok := absentRegistry[selectorType]
+	return value, ok
+}
+
+func isAbsentVariant(selector reflect.Value) bool {
+	value, ok := lookupAbsentVariant(selector.Type())
+	return ok && selector.Uint() == value
+}
+
+func lookupVariant(name string, selector reflect.Value) func() interface{} {
+	variantMutex.RLock()
+	defer variantMutex.RUnlock()
+
+	factory, ok := variantRegistry[variantKey{selector.Type(), selector.Uint()}]
+	if !ok {
+		panic(fmt.Errorf("Unknown variant for selector %s: %d", name, selector.Uint()))
+	}
+	return factory
+}
+
+func isUintKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+func isIntKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+// selectorIndex returns the index of the selector field for field i of the
+// struct type t, or -1 if the field is not a select field.
+func selectorIndex(t reflect.Type, i int, opts fieldOptions) int {
+	if opts.selector == "" {
+		return -1
+	}
+
+	f, ok := t.FieldByName(opts.selector)
+	if !ok || len(f.Index) != 1 || f.Index[0] >= i {
+		panic(fmt.Errorf("Selector %s must be an earlier field", opts.selector))
+	}
+
+	if !isUintKind(f.Type.Kind()) {
+		panic(fmt.Errorf("Selector %s must be an unsigned integer", opts.selector))
+	}
+
+	return f.Index[0]
+}
+
+//////////
+
+// absentSelector returns the value to be encoded for a selector whose
+// select field is nil, if one is registered for the selector's type
+func absentSelector(selector reflect.Value) (reflect.Value, bool) {
+	value, ok := lookupAbsentVariant(selector.Type())
+	if !ok {
+		return selector, false
+	}
+
+	absent := reflect.New(selector.Type()).Elem()
+	absent.SetUint(value)
+	return absent, true
+}
+
+func variantEncoder(e *encodeState, v, selector reflect.Value, opts fieldOptions) {
+	if v.IsNil() {
+		// The struct encoder has already written the absent value for the
+		// selector, if there is one
+		if _, ok := lookupAbsentVariant(selector.Type()); ok {
+			return
+		}
+		panic(fmt.Errorf("Cannot encode nil variant"))
+	}
+
+	factory := lookupVariant(opts.selector, selector)
+
+	concrete := v.Elem()
+	expected := reflect.TypeOf(factory())
+	if concrete.Type() != expected {
+		panic(fmt.Errorf("Variant type does not match selector %s: %s != %s",
+			opts.selector, concrete.Type(), expected))
+	}
+
+	typeEncoder(concrete.Type())(e, concrete, fieldOptions{})
+}
+
+func variantDecoder(d *decodeState, v, selector reflect.Value, opts fieldOptions) int {
+	if isAbsentVariant(selector) {
+		v.Set(reflect.Zero(v.Type()))
+		return 0
+	}
+
+	factory := lookupVariant(opts.selector, selector)
+
+	ptr := reflect.ValueOf(factory())
+	if !ptr.Type().AssignableTo(v.Type()) {
+		panic(fmt.Errorf("Variant type cannot be assigned to select field (%s)", ptr.Type()))
+	}
+
+	read := typeDecoder(ptr.Type().Elem())(d, ptr, fieldOptions{})
+	v.Set(ptr)
+	return read
+}
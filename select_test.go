@@ -0,0 +1,137 @@
+package syntax
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type selectTestType uint16
+
+type selectTestA struct {
+	A uint16
+}
+
+type selectTestB struct {
+	B []byte `tls:"head=1"`
+}
+
+type selectTestVarint struct {
+	Type selectTestType `tls:"varint"`
+	Body interface{}    `tls:"select=Type"`
+}
+
+type selectTestOptionalType uint8
+
+type selectTestOptional struct {
+	Type selectTestOptionalType
+	Body interface{} `tls:"select=Type"`
+}
+
+type selectTestFixed struct {
+	Type selectTestType
+	Body interface{} `tls:"select=Type"`
+}
+
+func init() {
+	RegisterVariant(selectTestType(0), 0x01, func() interface{} { return new(selectTestA) })
+	RegisterVariant(selectTestType(0), 0x1234, func() interface{} { return new(selectTestB) })
+
+	RegisterAbsentVariant(selectTestOptionalType(0), 0x00)
+	RegisterVariant(selectTestOptionalType(0), 0x01, func() interface{} { return new(selectTestA) })
+}
+
+func TestSelect(t *testing.T) {
+	cases := map[string]struct {
+		value    interface{}
+		encoding []byte
+	}{
+		"varint-a": {
+			value:    selectTestVarint{Type: 0x01, Body: &selectTestA{A: 0xB0A0}},
+			encoding: unhex("01" + "B0A0"),
+		},
+		"varint-b": {
+			value:    selectTestVarint{Type: 0x1234, Body: &selectTestB{B: []byte{0xC0, 0xC1}}},
+			encoding: unhex("5234" + "02C0C1"),
+		},
+		"optional-absent": {
+			value:    selectTestOptional{Type: 0x00, Body: nil},
+			encoding: unhex("00"),
+		},
+		"optional-present": {
+			value:    selectTestOptional{Type: 0x01, Body: &selectTestA{A: 0xB0A0}},
+			encoding: unhex("01" + "B0A0"),
+		},
+		"fixed-b": {
+			value:    selectTestFixed{Type: 0x1234, Body: &selectTestB{B: []byte{0xC0, 0xC1}}},
+			encoding: unhex("1234" + "02C0C1"),
+		},
+	}
+
+	for label, testCase := range cases {
+		encoding, err := Marshal(testCase.value)
+		require.Nil(t, err, label)
+		require.Equal(t, encoding, testCase.encoding, label)
+
+		switch testCase.value.(type) {
+		case selectTestVarint:
+			var decoded selectTestVarint
+			read, err := Unmarshal(encoding, &decoded)
+			require.Nil(t, err, label)
+			require.Equal(t, read, len(encoding), label)
+			require.Equal(t, decoded, testCase.value, label)
+
+		case selectTestOptional:
+			var decoded selectTestOptional
+			read, err := Unmarshal(encoding, &decoded)
+			require.Nil(t, err, label)
+			require.Equal(t, read, len(encoding), label)
+			require.Equal(t, decoded, testCase.value, label)
+
+		case selectTestFixed:
+			var decoded selectTestFixed
+			read, err := Unmarshal(encoding, &decoded)
+			require.Nil(t, err, label)
+			require.Equal(t, read, len(encoding), label)
+			require.Equal(t, decoded, testCase.value, label)
+		}
+	}
+}
+
+func TestSelectAbsent(t *testing.T) {
+	// A nil variant is encoded with the absent selector value, regardless of
+	// the value of the selector field
+	encoding, err := Marshal(selectTestOptional{Type: 0x01, Body: nil})
+	require.Nil(t, err)
+	require.Equal(t, encoding, unhex("00"))
+
+	// Decoding an absent variant clears the select field
+	decoded := selectTestOptional{Type: 0x01, Body: &selectTestA{A: 0xB0A0}}
+	_, err = Unmarshal(encoding, &decoded)
+	require.Nil(t, err)
+	require.Nil(t, decoded.Body)
+}
+
+func TestSelectErrors(t *testing.T) {
+	_, err := Marshal(selectTestVarint{Type: 0x02, Body: &selectTestA{}})
+	require.NotNil(t, err)
+
+	_, err = Marshal(selectTestVarint{Type: 0x01, Body: &selectTestB{}})
+	require.NotNil(t, err)
+
+	_, err = Marshal(selectTestVarint{Type: 0x01, Body: nil})
+	require.NotNil(t, err)
+
+	// An unknown selector value is reported with the selector's name
+	var decoded selectTestVarint
+	_, err = Unmarshal(unhex("02"+"B0A0"), &decoded)
+	require.NotNil(t, err)
+	require.True(t, strings.Contains(err.Error(), "selector Type: 2"), err.Error())
+
+	_, err = Marshal(struct {
+		Body interface{} `tls:"select=Type"`
+		Type selectTestType
+	}{})
+	require.NotNil(t, err)
+}
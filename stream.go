@@ -1,5 +1,11 @@
 package syntax
 
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
 ///
 /// Write Stream
 ///
@@ -74,3 +80,237 @@ func (s *ReadStream) ReadAll(vals ...interface{}) (int, error) {
 func (s *ReadStream) Position() int {
 	return s.cursor
 }
+
+///
+/// Cursor
+///
+
+type Cursor struct {
+	data   []byte
+	offset int
+}
+
+func NewCursor(data []byte) *Cursor {
+	return &Cursor{data, 0}
+}
+
+// Next decodes the next message from the underlying data into val and
+// advances past it.  It returns io.EOF once the data is exhausted.
+func (c *Cursor) Next(val interface{}) error {
+	if c.offset >= len(c.data) {
+		return io.EOF
+	}
+
+	read, err := Unmarshal(c.data[c.offset:], val)
+	if err != nil {
+		return err
+	}
+
+	c.offset += read
+	return nil
+}
+
+///
+/// Encoder
+///
+
+// An Encoder writes a sequence of messages to an io.Writer.  A framed
+// Encoder writes each message as a frame, preceded by a length header of a
+// fixed number of bytes.
+type Encoder struct {
+	w        io.Writer
+	headSize int
+	opts     EncodeOptions
+	buf      bytes.Buffer
+}
+
+// NewEncoder returns an Encoder that writes messages to w without framing,
+// one after another.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// NewFramedEncoder returns an Encoder that writes each message to w as a
+// frame with a headSize-byte length header.
+func NewFramedEncoder(w io.Writer, headSize int) *Encoder {
+	return &Encoder{w: w, headSize: headSize}
+}
+
+// SetOptions sets the options used to encode subsequent messages.  Frame
+// headers are always big-endian, regardless of opts.ByteOrder.
+func (enc *Encoder) SetOptions(opts EncodeOptions) {
+	enc.opts = opts
+}
+
+// Encode writes the encoding of val to the underlying writer.  Nothing is
+// written if val cannot be encoded.
+func (enc *Encoder) Encode(val interface{}) error {
+	if enc.headSize < 0 || enc.headSize > 4 {
+		return fmt.Errorf("Invalid frame header size: %d", enc.headSize)
+	}
+
+	enc.buf.Reset()
+	enc.buf.Write(make([]byte, enc.headSize))
+	if err := marshalToBuffer(&enc.buf, val, enc.opts); err != nil {
+		return err
+	}
+
+	length := enc.buf.Len() - enc.headSize
+	if enc.headSize > 0 {
+		if length>>uint(8*enc.headSize) > 0 {
+			return fmt.Errorf("Encoded length too long for frame header [%d, %d]", length, enc.headSize)
+		}
+		putUint(enc.buf.Bytes()[:enc.headSize], uint64(length), BigEndian)
+	}
+
+	_, err := enc.w.Write(enc.buf.Bytes())
+	return err
+}
+
+///
+/// Decoder
+///
+
+// A Decoder reads a sequence of messages from an io.Reader.  A framed
+// Decoder reads each message as a frame, consisting of a length header of a
+// fixed number of bytes followed by the encoding of the message.
+//
+// Without framing, the Decoder reads only as much of the stream as the
+// message requires, leaving the rest for the next message.  This works for
+// messages whose length is determined by their own headers.  A message that
+// ends with a `head=none` vector must be framed instead, as must one holding
+// an Unmarshaler outside a `head`-framed field, since UnmarshalTLS is only
+// given the data read so far.
+type Decoder struct {
+	r        io.Reader
+	headSize int
+	opts     DecodeOptions
+	buf      []byte
+	offset   int64
+
+	// MaxFrameSize, if non-zero, is the largest frame the Decoder will
+	// accept.  The length header is checked against it before any of the
+	// frame body is read.  Without framing, it bounds the message length.
+	MaxFrameSize int
+}
+
+// NewDecoder returns a Decoder that reads messages from r without framing.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// NewFramedDecoder returns a Decoder that reads each message from r as a
+// frame with a headSize-byte length header.
+func NewFramedDecoder(r io.Reader, headSize int) *Decoder {
+	return &Decoder{r: r, headSize: headSize}
+}
+
+// SetOptions sets the options used to decode subsequent messages.  Frame
+// headers are always big-endian, regardless of opts.ByteOrder.  Warnings are
+// recorded once per message, even if decoding an unframed message has to be
+// retried as more of the stream is read.
+func (dec *Decoder) SetOptions(opts DecodeOptions) {
+	dec.opts = opts
+}
+
+// InputOffset returns the number of bytes of the stream consumed by the
+// messages decoded so far.
+func (dec *Decoder) InputOffset() int64 {
+	return dec.offset
+}
+
+// Decode reads the next message and decodes it into val, returning the
+// number of bytes of the stream it consumed, including any frame header.  A
+// framed message must consume the whole frame.  It returns io.EOF if there
+// are no more messages.
+func (dec *Decoder) Decode(val interface{}) (int, error) {
+	if dec.headSize < 0 || dec.headSize > 4 {
+		return 0, fmt.Errorf("Invalid frame header size: %d", dec.headSize)
+	}
+
+	if dec.headSize == 0 {
+		return dec.decodeUnframed(val)
+	}
+
+	head := make([]byte, dec.headSize)
+	if _, err := io.ReadFull(dec.r, head); err != nil {
+		return 0, err
+	}
+
+	length := int(decodeUintFromBuffer(head))
+	if dec.MaxFrameSize > 0 && length > dec.MaxFrameSize {
+		return 0, fmt.Errorf("Frame length exceeds maximum [%d > %d]", length, dec.MaxFrameSize)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(dec.r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+
+	read, err := UnmarshalWithOptions(body, val, dec.opts)
+	if err != nil {
+		return 0, err
+	}
+
+	if read != length {
+		return 0, fmt.Errorf("Frame not fully consumed [%d < %d]", read, length)
+	}
+
+	dec.offset += int64(dec.headSize + length)
+	return dec.headSize + length, nil
+}
+
+// decodeUnframed decodes a message from the data buffered so far, reading
+// more whenever the decoder runs out, until the message is complete
+func (dec *Decoder) decodeUnframed(val interface{}) (int, error) {
+	for {
+		// Warnings are collected separately for each attempt, so that
+		// only those of the attempt that succeeds are kept
+		var warnings []Warning
+		opts := dec.opts
+		opts.Warnings = &warnings
+
+		needed := 0
+		d := newDecodeState(dec.buf, opts)
+		d.needed = &needed
+
+		read, err := d.unmarshal(val)
+		if err == nil {
+			if dec.opts.VerifyRoundtrip {
+				if err := verifyRoundtrip(dec.buf[:read], val, dec.opts); err != nil {
+					return 0, err
+				}
+			}
+
+			if dec.opts.Warnings != nil {
+				*dec.opts.Warnings = append(*dec.opts.Warnings, warnings...)
+			}
+
+			dec.buf = dec.buf[read:]
+			dec.offset += int64(read)
+			return read, nil
+		}
+
+		// The error is not due to a lack of data
+		if needed <= len(dec.buf) {
+			return 0, err
+		}
+
+		if dec.MaxFrameSize > 0 && needed > dec.MaxFrameSize {
+			return 0, fmt.Errorf("Message length exceeds maximum [%d > %d]", needed, dec.MaxFrameSize)
+		}
+
+		more := make([]byte, needed-len(dec.buf))
+		if n, err := io.ReadFull(dec.r, more); err != nil {
+			if err == io.EOF && len(dec.buf) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			dec.buf = append(dec.buf, more[:n]...)
+			return 0, err
+		}
+		dec.buf = append(dec.buf, more...)
+	}
+}
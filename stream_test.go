@@ -1,7 +1,10 @@
 package syntax
 
 import (
+	"bytes"
+	"io"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/require"
 )
@@ -90,3 +93,234 @@ func TestReadStream(t *testing.T) {
 	require.Equal(t, val4, val4a)
 
 }
+
+func TestCursor(t *testing.T) {
+	messages := []streamTestVec{
+		{[]byte{0xA0}},
+		{[]byte{}},
+		{[]byte{0xC0, 0xC1, 0xC2}},
+	}
+	c := NewCursor(unhex("0001A0" + "0000" + "0003C0C1C2"))
+
+	for _, expected := range messages {
+		var val streamTestVec
+		err := c.Next(&val)
+		require.Nil(t, err)
+		require.Equal(t, val, expected)
+	}
+
+	var val streamTestVec
+	err := c.Next(&val)
+	require.Equal(t, err, io.EOF)
+
+	c = NewCursor(unhex("0001A0" + "0003C0"))
+	err = c.Next(&val)
+	require.Nil(t, err)
+	err = c.Next(&val)
+	require.NotNil(t, err)
+	require.NotEqual(t, err, io.EOF)
+}
+
+// A streamTestReader serves a fixed header and fails the test if anything
+// beyond the header is read
+type streamTestReader struct {
+	t    *testing.T
+	head []byte
+}
+
+func (r *streamTestReader) Read(p []byte) (int, error) {
+	if len(r.head) == 0 {
+		r.t.Fatalf("Read past frame header")
+	}
+
+	n := copy(p, r.head)
+	r.head = r.head[n:]
+	return n, nil
+}
+
+func TestDecoder(t *testing.T) {
+	dec := NewFramedDecoder(bytes.NewReader(unhex("0003"+"0001A0"+"0002"+"0000"+"0002"+"0003")), 2)
+	dec.MaxFrameSize = 3
+
+	var val streamTestVec
+	_, err := dec.Decode(&val)
+	require.Nil(t, err)
+	require.Equal(t, val, streamTestVec{[]byte{0xA0}})
+
+	_, err = dec.Decode(&val)
+	require.Nil(t, err)
+	require.Equal(t, val, streamTestVec{[]byte{}})
+
+	// Truncated frame body
+	_, err = dec.Decode(&val)
+	require.NotNil(t, err)
+
+	dec = NewFramedDecoder(bytes.NewReader(nil), 2)
+	_, err = dec.Decode(&val)
+	require.Equal(t, err, io.EOF)
+
+	// Frame not fully consumed
+	dec = NewFramedDecoder(bytes.NewReader(unhex("0004"+"0001A0A1")), 2)
+	_, err = dec.Decode(&val)
+	require.NotNil(t, err)
+}
+
+func TestDecoderMaxFrameSize(t *testing.T) {
+	dec := NewFramedDecoder(&streamTestReader{t: t, head: unhex("FFFFFF")}, 3)
+	dec.MaxFrameSize = 1 << 16
+
+	var val streamTestVec
+	_, err := dec.Decode(&val)
+	require.NotNil(t, err)
+}
+
+func TestDecoderUnframed(t *testing.T) {
+	type message struct {
+		Type  uint8
+		Inner []streamTestVec `tls:"head=varint"`
+		Extra *uint16         `tls:"optional"`
+	}
+
+	extra := uint16(0xD0D1)
+	first := message{Type: 0xA0, Inner: []streamTestVec{{[]byte{0xB0}}, {[]byte{0xC0, 0xC1}}}, Extra: &extra}
+	second := message{Type: 0xA1, Inner: []streamTestVec{}}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	require.Nil(t, enc.Encode(first))
+	require.Nil(t, enc.Encode(second))
+	buf.Write(unhex("FF"))
+
+	// The decoder only reads as much as each message needs
+	r := bytes.NewReader(buf.Bytes())
+	dec := NewDecoder(iotest.OneByteReader(r))
+
+	var decoded message
+	read, err := dec.Decode(&decoded)
+	require.Nil(t, err)
+	require.Equal(t, read, 12)
+	require.Equal(t, decoded, first)
+	require.Equal(t, dec.InputOffset(), int64(12))
+	require.Equal(t, r.Len(), 4)
+
+	_, err = dec.Decode(&decoded)
+	require.Nil(t, err)
+	require.Equal(t, decoded.Type, second.Type)
+	require.Equal(t, decoded.Extra, second.Extra)
+	require.Equal(t, r.Len(), 1)
+
+	// A truncated message is an error, and an empty stream is the end
+	dec = NewDecoder(bytes.NewReader(unhex("A0" + "02")))
+	_, err = dec.Decode(&decoded)
+	require.Equal(t, err, io.ErrUnexpectedEOF)
+
+	dec = NewDecoder(bytes.NewReader(nil))
+	_, err = dec.Decode(&decoded)
+	require.Equal(t, err, io.EOF)
+
+	// Errors other than truncation are reported as-is
+	dec = NewDecoder(bytes.NewReader(unhex("A0" + "00" + "02")))
+	_, err = dec.Decode(&decoded)
+	require.NotNil(t, err)
+	require.NotEqual(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestDecoderUnframedLengthFrom(t *testing.T) {
+	first := lengthFromRecord{Type: 0x17, Version: 0x0303, Fragment: []byte{0xA0, 0xA1, 0xA2}}
+	second := lengthFromRecord{Type: 0x16, Version: 0x0303, Fragment: []byte{0xB0}}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	require.Nil(t, enc.Encode(first))
+	require.Nil(t, enc.Encode(second))
+
+	// The vector is read once its length is known
+	dec := NewDecoder(iotest.OneByteReader(&buf))
+	var decoded lengthFromRecord
+	read, err := dec.Decode(&decoded)
+	require.Nil(t, err)
+	require.Equal(t, read, 8)
+	require.Equal(t, decoded.Fragment, first.Fragment)
+
+	read, err = dec.Decode(&decoded)
+	require.Nil(t, err)
+	require.Equal(t, read, 6)
+	require.Equal(t, decoded.Fragment, second.Fragment)
+
+	_, err = dec.Decode(&decoded)
+	require.Equal(t, err, io.EOF)
+}
+
+func TestEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewFramedEncoder(&buf, 2)
+	require.Nil(t, enc.Encode(streamTestVec{[]byte{0xA0}}))
+	require.Nil(t, enc.Encode(uint8(0xB0)))
+	require.Equal(t, buf.Bytes(), unhex("0003"+"0001A0"+"0001"+"B0"))
+
+	// Nothing is written for a value that cannot be encoded
+	err := enc.Encode(float64(0))
+	require.NotNil(t, err)
+	require.Equal(t, buf.Len(), 8)
+
+	// The frame must fit the header
+	enc = NewFramedEncoder(&buf, 1)
+	err = enc.Encode(streamTestVec{buffer(0x100)})
+	require.NotNil(t, err)
+	require.Equal(t, buf.Len(), 8)
+
+	// Frames can be read back with a Decoder
+	dec := NewFramedDecoder(&buf, 2)
+	var val streamTestVec
+	read, err := dec.Decode(&val)
+	require.Nil(t, err)
+	require.Equal(t, read, 5)
+	require.Equal(t, val, streamTestVec{[]byte{0xA0}})
+}
+
+func TestStreamOptions(t *testing.T) {
+	type message struct {
+		A uint16
+		V uint16 `tls:"varint"`
+	}
+	value := message{A: 0xA0A1, V: 1}
+	encoding := unhex("A1A0" + "01")
+
+	// Byte order applies to the messages, but not to frame headers
+	var buf bytes.Buffer
+	enc := NewFramedEncoder(&buf, 2)
+	enc.SetOptions(EncodeOptions{ByteOrder: LittleEndian})
+	require.Nil(t, enc.Encode(value))
+	require.Equal(t, buf.Bytes(), append(unhex("0003"), encoding...))
+
+	dec := NewFramedDecoder(&buf, 2)
+	dec.SetOptions(DecodeOptions{ByteOrder: LittleEndian})
+	var decoded message
+	_, err := dec.Decode(&decoded)
+	require.Nil(t, err)
+	require.Equal(t, decoded, value)
+
+	// Without framing, warnings are recorded once per message, even though
+	// decoding is retried as each byte arrives
+	nonMinimal := unhex("A1A0" + "4001")
+	var warnings []Warning
+	dec = NewDecoder(iotest.OneByteReader(bytes.NewReader(nonMinimal)))
+	dec.SetOptions(DecodeOptions{ByteOrder: LittleEndian, Warnings: &warnings})
+	_, err = dec.Decode(&decoded)
+	require.Nil(t, err)
+	require.Equal(t, decoded, value)
+	require.Equal(t, len(warnings), 1)
+
+	// Strict mode rejects the same message
+	dec = NewDecoder(iotest.OneByteReader(bytes.NewReader(nonMinimal)))
+	dec.SetOptions(DecodeOptions{ByteOrder: LittleEndian, Strict: true})
+	_, err = dec.Decode(&decoded)
+	require.NotNil(t, err)
+
+	// Limits apply to each message
+	dec = NewDecoder(bytes.NewReader(unhex("0003" + "A0A1A2")))
+	dec.SetOptions(DecodeOptions{MaxSize: 2})
+	var vec streamTestVec
+	_, err = dec.Decode(&vec)
+	require.NotNil(t, err)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/hex"
 	"fmt"
+	"math"
 	"reflect"
 	"strings"
 	"testing"
@@ -75,6 +76,7 @@ func (cs CrypticString) ValidForTLS() error {
 
 func TestSuccessCases(t *testing.T) {
 	dummyUint16 := uint16(0xFFFF)
+	zeroUint16 := uint16(0x0000)
 	crypticHello := CrypticString("hello")
 	testCases := map[string]struct {
 		value    interface{}
@@ -98,6 +100,53 @@ func TestSuccessCases(t *testing.T) {
 			encoding: unhex("D0C0B0A090807060"),
 		},
 
+		// Ints
+		"int8-minus-one": {
+			value:    int8(-1),
+			encoding: unhex("FF"),
+		},
+		"int8-min": {
+			value:    int8(math.MinInt8),
+			encoding: unhex("80"),
+		},
+		"int16-min": {
+			value:    int16(math.MinInt16),
+			encoding: unhex("8000"),
+		},
+		"int16-max": {
+			value:    int16(math.MaxInt16),
+			encoding: unhex("7FFF"),
+		},
+		"int32-minus-two": {
+			value:    int32(-2),
+			encoding: unhex("FFFFFFFE"),
+		},
+		"int32-min": {
+			value:    int32(math.MinInt32),
+			encoding: unhex("80000000"),
+		},
+		"int64-min": {
+			value:    int64(math.MinInt64),
+			encoding: unhex("8000000000000000"),
+		},
+
+		// Bools
+		"bool-true": {
+			value:    true,
+			encoding: unhex("01"),
+		},
+		"bool-false": {
+			value:    false,
+			encoding: unhex("00"),
+		},
+		"bool-wide": {
+			value: struct {
+				A bool `tls:"size=2"`
+				B bool `tls:"size=4"`
+			}{A: true, B: false},
+			encoding: unhex("0001" + "00000000"),
+		},
+
 		// Varints
 		"varint8": {
 			value: struct {
@@ -124,6 +173,100 @@ func TestSuccessCases(t *testing.T) {
 			encoding: unhex("FFFFFFFFFFFFFFFF"),
 		},
 
+		"varint-zero": {
+			value: struct {
+				V uint64 `tls:"varint"`
+			}{V: 0},
+			encoding: unhex("00"),
+		},
+		"varint-min2": {
+			value: struct {
+				V uint64 `tls:"varint"`
+			}{V: 0x40},
+			encoding: unhex("4040"),
+		},
+		"varint-min4": {
+			value: struct {
+				V uint64 `tls:"varint"`
+			}{V: 0x4000},
+			encoding: unhex("80004000"),
+		},
+		"varint-min8": {
+			value: struct {
+				V uint64 `tls:"varint"`
+			}{V: 0x40000000},
+			encoding: unhex("C000000040000000"),
+		},
+
+		"varint-pad8": {
+			value: struct {
+				V uint8 `tls:"varint,pad=4"`
+			}{V: 0x3F},
+			encoding: unhex("8000003F"),
+		},
+		"varint-pad16": {
+			value: struct {
+				V uint16 `tls:"varint,pad=8"`
+			}{V: 0x3FFF},
+			encoding: unhex("C000000000003FFF"),
+		},
+		"varint-pad-minimal": {
+			value: struct {
+				V uint32 `tls:"varint,pad=2"`
+			}{V: 0x3FFF},
+			encoding: unhex("7FFF"),
+		},
+
+		// Signed varints
+		"varint-signed-minus-one": {
+			value: struct {
+				V int8 `tls:"varint"`
+			}{V: -1},
+			encoding: unhex("3F"),
+		},
+		"varint-signed-min1": {
+			value: struct {
+				V int16 `tls:"varint"`
+			}{V: -32},
+			encoding: unhex("20"),
+		},
+		"varint-signed-max1": {
+			value: struct {
+				V int16 `tls:"varint"`
+			}{V: 31},
+			encoding: unhex("1F"),
+		},
+		"varint-signed-min2": {
+			value: struct {
+				V int16 `tls:"varint"`
+			}{V: 32},
+			encoding: unhex("4020"),
+		},
+		"varint-signed-negative2": {
+			value: struct {
+				V int16 `tls:"varint"`
+			}{V: -33},
+			encoding: unhex("7FDF"),
+		},
+		"varint-signed-int16-min": {
+			value: struct {
+				V int16 `tls:"varint"`
+			}{V: math.MinInt16},
+			encoding: unhex("BFFF8000"),
+		},
+		"varint-signed-min8": {
+			value: struct {
+				V int64 `tls:"varint"`
+			}{V: -(1 << 61)},
+			encoding: unhex("E000000000000000"),
+		},
+		"varint-signed-pad": {
+			value: struct {
+				V int8 `tls:"varint,pad=4"`
+			}{V: -1},
+			encoding: unhex("BFFFFFFF"),
+		},
+
 		// Arrays
 		"array": {
 			value:    [5]uint16{0x0102, 0x0304, 0x0506, 0x0708, 0x090a},
@@ -155,6 +298,22 @@ func TestSuccessCases(t *testing.T) {
 			},
 			encoding: unhex("020000" + hexBuffer(0x20000)),
 		},
+		"slice-head-4": {
+			value: struct {
+				V []byte `tls:"head=4"`
+			}{
+				V: buffer(0x20000),
+			},
+			encoding: unhex("00020000" + hexBuffer(0x20000)),
+		},
+		"slice-head-8": {
+			value: struct {
+				V []byte `tls:"head=8"`
+			}{
+				V: buffer(0x20),
+			},
+			encoding: unhex("0000000000000020" + hexBuffer(0x20)),
+		},
 		"slice-none": {
 			value: struct {
 				V []byte `tls:"head=none"`
@@ -163,6 +322,16 @@ func TestSuccessCases(t *testing.T) {
 			},
 			encoding: unhex(hexBuffer(0x3FFF)),
 		},
+		"slice-fixed": {
+			value: struct {
+				V []byte `tls:"fixed=32"`
+				W uint8
+			}{
+				V: buffer(32),
+				W: 0xA0,
+			},
+			encoding: unhex(hexBuffer(32) + "A0"),
+		},
 		"slice-varint": {
 			value: struct {
 				V []byte `tls:"head=varint"`
@@ -171,6 +340,116 @@ func TestSuccessCases(t *testing.T) {
 			},
 			encoding: unhex("7FFF" + hexBuffer(0x3FFF)),
 		},
+		"slice-varint-nested": {
+			value: struct {
+				V [][]byte `tls:"head=varint"`
+			}{
+				V: [][]byte{buffer(0x40), {0xB0}},
+			},
+			encoding: unhex("4044" + "4040" + hexBuffer(0x40) + "01B0"),
+		},
+
+		// Text-encoded slices
+		"slice-base64-empty": {
+			value: struct {
+				V []byte `tls:"head=1,encoding=base64"`
+			}{
+				V: []byte{},
+			},
+			encoding: unhex("00"),
+		},
+		"slice-base64-pad2": {
+			value: struct {
+				V []byte `tls:"head=1,encoding=base64"`
+			}{
+				V: unhex("A0"),
+			},
+			encoding: unhex("04" + "6f413d3d"),
+		},
+		"slice-base64-pad1": {
+			value: struct {
+				V []byte `tls:"head=1,encoding=base64"`
+			}{
+				V: unhex("A0A1"),
+			},
+			encoding: unhex("04" + "6f4b453d"),
+		},
+		"slice-base64-pad0": {
+			value: struct {
+				V []byte `tls:"head=2,encoding=base64"`
+			}{
+				V: unhex("A0A1A2"),
+			},
+			encoding: unhex("0004" + "6f4b4769"),
+		},
+		"slice-hex": {
+			value: struct {
+				V []byte `tls:"head=2,encoding=hex"`
+			}{
+				V: unhex("A0A1"),
+			},
+			encoding: unhex("0004" + "61306131"),
+		},
+
+		// Sparse slices
+		"slice-sparse": {
+			value: struct {
+				V []uint16 `tls:"head=1,sparse=6"`
+			}{
+				V: []uint16{0, 0, 0xA0A1, 0, 0, 0xB0B1},
+			},
+			encoding: unhex("08" + "0002A0A1" + "0005B0B1"),
+		},
+		"slice-sparse-empty": {
+			value: struct {
+				V []uint16 `tls:"head=1,sparse=3"`
+			}{
+				V: []uint16{0, 0, 0},
+			},
+			encoding: unhex("00"),
+		},
+		"slice-sparse-opaque": {
+			value: struct {
+				V []byte `tls:"head=1,sparse=4"`
+			}{
+				V: []byte{0xA0, 0, 0, 0xA3},
+			},
+			encoding: unhex("06" + "0000A0" + "0003A3"),
+		},
+
+		// Strings
+		"string": {
+			value: struct {
+				V string `tls:"head=1"`
+			}{
+				V: "hello",
+			},
+			encoding: unhex("05" + "68656c6c6f"),
+		},
+		"cstring-empty": {
+			value: struct {
+				V string `tls:"size=4,cstring"`
+			}{
+				V: "",
+			},
+			encoding: unhex("00000000"),
+		},
+		"cstring-short": {
+			value: struct {
+				V string `tls:"size=8,cstring"`
+			}{
+				V: "hi",
+			},
+			encoding: unhex("6869" + "000000000000"),
+		},
+		"cstring-full": {
+			value: struct {
+				V string `tls:"size=5,cstring"`
+			}{
+				V: "hello",
+			},
+			encoding: unhex("68656c6c6f"),
+		},
 
 		// Maps
 		"map": {
@@ -182,6 +461,61 @@ func TestSuccessCases(t *testing.T) {
 			encoding: unhex("06000102000201"),
 		},
 
+		"slice-bias": {
+			value: struct {
+				V []byte `tls:"head=1,bias=-1"`
+			}{
+				V: []byte{0xA0, 0xA1, 0xA2},
+			},
+			encoding: unhex("02" + "A0A1A2"),
+		},
+
+		"ordered-map": {
+			value: struct {
+				V []struct {
+					K string `tls:"head=1"`
+					V []byte `tls:"head=2"`
+				} `tls:"head=2"`
+			}{
+				V: []struct {
+					K string `tls:"head=1"`
+					V []byte `tls:"head=2"`
+				}{
+					{K: "b", V: []byte{0xB0}},
+					{K: "a", V: []byte{0xA0, 0xA1}},
+				},
+			},
+			encoding: unhex("000b" + "0162" + "0001B0" + "0161" + "0002A0A1"),
+		},
+
+		"map-set": {
+			value: struct {
+				V map[ExtensionType]struct{} `tls:"head=1"`
+			}{
+				V: map[ExtensionType]struct{}{0x0102: {}, 0x0001: {}, 0x00FF: {}},
+			},
+			encoding: unhex("06" + "0001" + "00FF" + "0102"),
+		},
+
+		// Bits
+		"bits-16": {
+			value: struct {
+				V [16]bool `tls:"bits"`
+			}{
+				V: [16]bool{true, false, false, false, false, false, false, true,
+					false, true, false, true, false, false, false, false},
+			},
+			encoding: unhex("8150"),
+		},
+		"bits-10": {
+			value: struct {
+				V [10]bool `tls:"bits"`
+			}{
+				V: [10]bool{true, true, false, false, false, false, false, false, true, true},
+			},
+			encoding: unhex("C0C0"),
+		},
+
 		// Struct
 		"struct": {
 			value: struct {
@@ -207,6 +541,37 @@ func TestSuccessCases(t *testing.T) {
 			},
 			encoding: unhex("B0A0" + "10111213202122233031323340414243"),
 		},
+		"struct-group": {
+			value: struct {
+				A uint8
+				_ struct{} `tls:"group=3"`
+				B uint16
+				C []uint16 `tls:"head=2"`
+				_ struct{} `tls:"group=end"`
+				D uint8
+			}{
+				A: 0x01,
+				B: 0x0303,
+				C: []uint16{0xA0A1, 0xA2A3},
+				D: 0xFF,
+			},
+			encoding: unhex("01" + "000008" + "0303" + "0004A0A1A2A3" + "FF"),
+		},
+		"struct-group-nested": {
+			value: struct {
+				_ struct{} `tls:"group=2"`
+				A uint8
+				_ struct{} `tls:"group=1"`
+				B uint16
+				_ struct{} `tls:"group=end"`
+				C uint8
+			}{
+				A: 0xA0,
+				B: 0xB0B1,
+				C: 0xC0,
+			},
+			encoding: unhex("0005" + "A0" + "02B0B1" + "C0"),
+		},
 		"struct-pointer": {
 			value:    struct{ V *uint16 }{V: &dummyUint16},
 			encoding: unhex("FFFF"),
@@ -229,6 +594,22 @@ func TestSuccessCases(t *testing.T) {
 			},
 			encoding: unhex("01FFFF"),
 		},
+		"optional-sentinel-absent": {
+			value: struct {
+				A *uint16 `tls:"optional,absent=0xFFFF"`
+			}{
+				A: nil,
+			},
+			encoding: unhex("FFFF"),
+		},
+		"optional-sentinel-present": {
+			value: struct {
+				A *uint16 `tls:"optional,absent=0xFFFF"`
+			}{
+				A: &zeroUint16,
+			},
+			encoding: unhex("0000"),
+		},
 		"optional-marshaler-absent": {
 			value: struct {
 				A *CrypticString `tls:"optional"`
@@ -263,6 +644,14 @@ func TestSuccessCases(t *testing.T) {
 			},
 			encoding: unhex("056e62646565" + "B0A0" + "0a2522232e787f637e7735"),
 		},
+		"slice-marshaler": {
+			value: struct {
+				V []CrypticString `tls:"head=2"`
+			}{
+				V: []CrypticString{"hello", "... world!"},
+			},
+			encoding: unhex("0011" + "056e62646565" + "0a2522232e787f637e7735"),
+		},
 	}
 
 	for label, testCase := range testCases {
@@ -283,3 +672,50 @@ func TestSuccessCases(t *testing.T) {
 		})
 	}
 }
+
+func TestByteOrder(t *testing.T) {
+	type message struct {
+		A uint16
+		B []uint32 `tls:"head=2"`
+		C uint32   `tls:"be"`
+		D uint16   `tls:"varint"`
+		_ struct{} `tls:"group=2"`
+		E uint64
+	}
+
+	value := message{
+		A: 0xA0A1,
+		B: []uint32{0xB0B1B2B3},
+		C: 0xC0C1C2C3,
+		D: 0x3FFF,
+		E: 0xE0E1E2E3E4E5E6E7,
+	}
+	bigEndian := unhex("A0A1" + "0004B0B1B2B3" + "C0C1C2C3" + "7FFF" + "0008E0E1E2E3E4E5E6E7")
+	littleEndian := unhex("A1A0" + "0400B3B2B1B0" + "C0C1C2C3" + "7FFF" + "0800E7E6E5E4E3E2E1E0")
+
+	encoding, err := MarshalWithOptions(value, EncodeOptions{ByteOrder: BigEndian})
+	require.Nil(t, err)
+	require.Equal(t, encoding, bigEndian)
+
+	encoding, err = MarshalWithOptions(value, EncodeOptions{ByteOrder: LittleEndian})
+	require.Nil(t, err)
+	require.Equal(t, encoding, littleEndian)
+
+	var decoded message
+	read, err := UnmarshalWithOptions(littleEndian, &decoded, DecodeOptions{ByteOrder: LittleEndian})
+	require.Nil(t, err)
+	require.Equal(t, read, len(littleEndian))
+	require.Equal(t, decoded, value)
+
+	// Per-field tags apply regardless of the default
+	tagged := struct {
+		A uint16   `tls:"le"`
+		B []uint16 `tls:"head=2,le"`
+	}{
+		A: 0xA0A1,
+		B: []uint16{0xB0B1},
+	}
+	encoding, err = Marshal(tagged)
+	require.Nil(t, err)
+	require.Equal(t, encoding, unhex("A1A0"+"0200B1B0"))
+}
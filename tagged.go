@@ -0,0 +1,121 @@
+package syntax
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// A value of an interface type can be decoded if its concrete types are
+// self-identifying, i.e., if each encoding begins with a type tag that the
+// concrete type writes and reads itself.  The concrete type for each tag is
+// registered with RegisterTagged:
+//
+//	type Shape interface{}
+//
+//	func init() {
+//		RegisterTagged((*Shape)(nil), 1, 0x01, func() interface{} { return new(Circle) })
+//		RegisterTagged((*Shape)(nil), 1, 0x02, func() interface{} { return new(Square) })
+//	}
+//
+// On decode, the tag is peeked without being consumed, and the value is
+// decoded as the registered type, starting with the tag.  This allows
+// vectors of heterogeneous values without a separate selector field.  On
+// encode, the concrete value is encoded as-is.
+
+type taggedInfo struct {
+	tagSize   int
+	factories map[uint64]func() interface{}
+}
+
+var (
+	taggedMutex    sync.RWMutex
+	taggedRegistry = map[reflect.Type]*taggedInfo{}
+)
+
+// RegisterTagged registers the concrete type to be used when decoding a value
+// of the interface type pointed to by `iface` whose encoding begins with
+// `tag`, as a `tagSize`-byte integer.  All of the types registered for an
+// interface must use the same tag size.  The factory must return a pointer
+// to a new value of the concrete type, which must implement the interface.
+func RegisterTagged(iface interface{}, tagSize int, tag uint, factory func() interface{}) {
+	ifaceType := reflect.TypeOf(iface)
+	if ifaceType == nil || ifaceType.Kind() != reflect.Ptr || ifaceType.Elem().Kind() != reflect.Interface {
+		panic(fmt.Errorf("Tagged type must be registered with a pointer to an interface"))
+	}
+	ifaceType = ifaceType.Elem()
+
+	if tagSize < 1 || tagSize > 8 {
+		panic(fmt.Errorf("Invalid tag size: %d", tagSize))
+	}
+
+	concrete := reflect.TypeOf(factory())
+	if concrete.Kind() != reflect.Ptr || !concrete.Implements(ifaceType) {
+		panic(fmt.Errorf("Tagged factory must return a pointer that implements %s", ifaceType))
+	}
+
+	taggedMutex.Lock()
+	defer taggedMutex.Unlock()
+
+	info, ok := taggedRegistry[ifaceType]
+	if !ok {
+		info = &taggedInfo{tagSize: tagSize, factories: map[uint64]func() interface{}{}}
+		taggedRegistry[ifaceType] = info
+	}
+
+	if info.tagSize != tagSize {
+		panic(fmt.Errorf("Inconsistent tag size for %s: %d != %d", ifaceType, tagSize, info.tagSize))
+	}
+
+	info.factories[uint64(tag)] = factory
+}
+
+func lookupTagSize(ifaceType reflect.Type) int {
+	taggedMutex.RLock()
+	defer taggedMutex.RUnlock()
+
+	info, ok := taggedRegistry[ifaceType]
+	if !ok {
+		panic(fmt.Errorf("No tagged types registered for interface (%s)", ifaceType))
+	}
+	return info.tagSize
+}
+
+func lookupTagged(ifaceType reflect.Type, tag uint64) func() interface{} {
+	taggedMutex.RLock()
+	defer taggedMutex.RUnlock()
+
+	factory, ok := taggedRegistry[ifaceType].factories[tag]
+	if !ok {
+		panic(fmt.Errorf("Unknown type tag for %s: %#x", ifaceType, tag))
+	}
+	return factory
+}
+
+//////////
+
+func interfaceEncoder(e *encodeState, v reflect.Value, opts fieldOptions) {
+	if v.IsNil() {
+		panic(fmt.Errorf("Cannot encode nil interface"))
+	}
+
+	concrete := v.Elem()
+	typeEncoder(concrete.Type())(e, concrete, fieldOptions{})
+}
+
+func taggedDecoder(d *decodeState, v reflect.Value, opts fieldOptions) int {
+	ifaceType := v.Elem().Type()
+	tagSize := lookupTagSize(ifaceType)
+	data := d.peek(tagSize)
+	if data == nil {
+		panic(fmt.Errorf("Insufficient data to read type tag"))
+	}
+
+	tag := decodeUintWithOrder(data, opts.byteOrder(d.opts.ByteOrder))
+	factory := lookupTagged(ifaceType, tag)
+
+	ptr := reflect.ValueOf(factory())
+	read := typeDecoder(ptr.Type().Elem())(d, ptr, fieldOptions{})
+	v.Elem().Set(ptr)
+	return read
+}
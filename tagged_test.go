@@ -0,0 +1,75 @@
+package syntax
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type taggedShape interface{}
+
+// Each shape begins with its own type tag
+type taggedCircle struct {
+	Tag    uint8
+	Radius uint16
+}
+
+type taggedSquare struct {
+	Tag  uint8
+	Side []byte `tls:"head=1"`
+}
+
+func init() {
+	RegisterTagged((*taggedShape)(nil), 1, 0x01, func() interface{} { return new(taggedCircle) })
+	RegisterTagged((*taggedShape)(nil), 1, 0x02, func() interface{} { return new(taggedSquare) })
+}
+
+func TestTagged(t *testing.T) {
+	type shapes struct {
+		Shapes []taggedShape `tls:"head=1"`
+	}
+
+	value := shapes{Shapes: []taggedShape{
+		&taggedCircle{Tag: 0x01, Radius: 0xA0A1},
+		&taggedSquare{Tag: 0x02, Side: []byte{0xB0, 0xB1}},
+		&taggedCircle{Tag: 0x01, Radius: 0xC0C1},
+	}}
+	encoding := unhex("0A" + "01A0A1" + "0202B0B1" + "01C0C1")
+
+	out, err := Marshal(value)
+	require.Nil(t, err)
+	require.Equal(t, out, encoding)
+
+	var decoded shapes
+	read, err := Unmarshal(out, &decoded)
+	require.Nil(t, err)
+	require.Equal(t, read, len(out))
+	require.Equal(t, decoded, value)
+}
+
+func TestTaggedErrors(t *testing.T) {
+	type shapes struct {
+		Shapes []taggedShape `tls:"head=1"`
+	}
+
+	// Unknown tag
+	var decoded shapes
+	_, err := Unmarshal(unhex("03"+"03A0A1"), &decoded)
+	require.NotNil(t, err)
+
+	// Nil interface
+	_, err = Marshal(shapes{Shapes: []taggedShape{nil}})
+	require.NotNil(t, err)
+
+	// Unregistered interface
+	var unregistered struct {
+		Value interface{ Area() int }
+	}
+	_, err = Unmarshal(unhex("01"), &unregistered)
+	require.NotNil(t, err)
+
+	// Inconsistent tag size
+	require.Panics(t, func() {
+		RegisterTagged((*taggedShape)(nil), 2, 0x0003, func() interface{} { return new(taggedCircle) })
+	})
+}
@@ -16,18 +16,76 @@ var (
 	validatorType = reflect.TypeOf(new(Validator)).Elem()
 )
 
+// ByteOrder specifies the order in which the bytes of fixed-width integers and
+// length headers are written.  Varints are always big-endian.
+type ByteOrder int
+
+const (
+	BigEndian ByteOrder = iota
+	LittleEndian
+)
+
 // `tls:"head=2,min=2,max=255,varint"`
 
 type fieldOptions struct {
-	omitHeader   bool // whether to omit the slice header
-	varintHeader bool // whether to encode the header length as a varint
-	headerSize   int  // length of length in bytes
-	minSize      int  // minimum vector size in bytes
-	maxSize      int  // maximum vector size in bytes
-
-	varint   bool // whether to encode as a varint
-	optional bool // whether to encode pointer as optional
-	omit     bool // whether to skip a field
+	omitHeader   bool   // whether to omit the slice header
+	varintHeader bool   // whether to encode the header length as a varint
+	headerSize   int    // length of length in bytes
+	minSize      int    // minimum vector size in bytes
+	maxSize      int    // maximum vector size in bytes
+	minCount     int    // minimum number of elements in a vector or map
+	maxCount     int    // maximum number of elements in a vector or map
+	required     bool   // whether a nil slice or map is an error
+	encoding     string // text encoding to apply to an opaque vector
+	sparseLen    int    // dense length of a vector sent as index/value pairs
+	lengthBias   int    // offset added to the length before it is encoded
+	fixedLength  int    // exact length of an opaque vector sent without a header
+	numericKeys  bool   // whether to sort map keys by value, rather than by encoding
+
+	fixedSize int  // fixed size of the field in bytes
+	cstring   bool // whether to encode a string as a NUL-padded buffer
+	bits      bool // whether to pack an array of bools into bits
+
+	charset string // name of the charset that a string must belong to
+
+	varint    bool   // whether to encode as a varint
+	varintPad int    // fixed length of a padded varint, in bytes
+	optional  bool   // whether to encode pointer as optional
+	omit      bool   // whether to skip a field
+	selector  string // name of the field that selects this field's type
+
+	absent    *uint64 // value that marks an optional as absent, instead of a presence octet
+	omitEmpty bool    // whether to encode an optional that points to zero as absent
+
+	lengthFrom string // name of the field that holds the length of this vector
+	widthFrom  string // name of the field that holds the width of this vector's header
+
+	presenceSize int // width of the presence field of an optional, in bytes
+
+	presenceField string // name of the flags field that indicates whether this field is present
+	presenceBit   int    // bit of the flags field that indicates presence
+
+	groupHeaderSize int  // length of length for a group of fields
+	groupEnd        bool // whether this field ends a group
+
+	littleEndian bool // whether to write integers little-endian
+	bigEndian    bool // whether to write integers big-endian
+
+	checksum      bool   // whether the field holds a checksum of other fields
+	checksumFirst string // name of the first field covered by the checksum
+	checksumLast  string // name of the last field covered by the checksum
+}
+
+// byteOrder returns the byte order for integers in a field, defaulting to
+// the byte order for the whole encoding
+func (opts fieldOptions) byteOrder(def ByteOrder) ByteOrder {
+	switch {
+	case opts.littleEndian:
+		return LittleEndian
+	case opts.bigEndian:
+		return BigEndian
+	}
+	return def
 }
 
 func mutuallyExclusive(vals []bool) bool {
@@ -42,54 +100,215 @@ func mutuallyExclusive(vals []bool) bool {
 
 func (opts fieldOptions) Consistent() bool {
 	// No more than one of the header options must be set
-	headerPaths := []bool{opts.omitHeader, opts.varintHeader, opts.headerSize > 1}
+	headerPaths := []bool{opts.omitHeader, opts.varintHeader, opts.headerSize > 0, opts.lengthFrom != "",
+		opts.fixedLength > 0, opts.widthFrom != ""}
 	if !mutuallyExclusive(headerPaths) {
 		return false
 	}
 
+	// Padding only applies to varints, and must be a valid varint length
+	if opts.varintPad != 0 && (!opts.varint || !validVarintLength(opts.varintPad)) {
+		return false
+	}
+
+	// At most one byte order may be specified
+	if !mutuallyExclusive([]bool{opts.littleEndian, opts.bigEndian}) {
+		return false
+	}
+
+	// A C string must have a fixed size, and cannot have a header
+	if opts.cstring && (opts.fixedSize <= 0 || opts.omitHeader || opts.varintHeader || opts.headerSize > 0 ||
+		opts.lengthFrom != "") {
+		return false
+	}
+
+	// A fixed length determines the length of the vector, so length bounds
+	// and transformations do not apply
+	if opts.fixedLength > 0 && (opts.minSize > 0 || opts.maxSize > 0 || opts.minCount > 0 || opts.maxCount > 0 ||
+		opts.encoding != "" || opts.sparseLen > 0) {
+		return false
+	}
+
+	// A length bias requires a header to apply it to
+	if opts.lengthBias != 0 && !opts.varintHeader && opts.headerSize == 0 {
+		return false
+	}
+
+	// An absence marker and omitempty only apply to optionals, so that
+	// decoding remains unambiguous
+	if (opts.absent != nil || opts.omitEmpty) && !opts.optional {
+		return false
+	}
+
+	// A wide presence field replaces the presence octet, so it is exclusive
+	// with an absence marker
+	if opts.presenceSize != 0 && (!opts.optional || opts.absent != nil || opts.presenceSize < 1 || opts.presenceSize > 8) {
+		return false
+	}
+
 	// Max must be greater than min
 	if opts.maxSize > 0 && opts.minSize > opts.maxSize {
 		return false
 	}
+	if opts.maxCount > 0 && opts.minCount > opts.maxCount {
+		return false
+	}
 
 	// varint and optional are mutually exclusive with each other, and with the slice options
-	headerOpts := (opts.omitHeader || opts.varintHeader || opts.headerSize > 1 || opts.maxSize > 0 || opts.minSize > 0)
-	encodePaths := []bool{headerOpts, opts.varint, opts.optional}
+	headerOpts := (opts.omitHeader || opts.varintHeader || opts.headerSize > 0 || opts.maxSize > 0 || opts.minSize > 0 ||
+		opts.required || opts.encoding != "" || opts.sparseLen > 0 || opts.lengthBias != 0 || opts.lengthFrom != "" ||
+		opts.minCount > 0 || opts.maxCount > 0 || opts.fixedLength > 0 || opts.numericKeys || opts.widthFrom != "")
+	encodePaths := []bool{headerOpts, opts.varint, opts.optional, opts.selector != "", opts.bits, opts.checksum,
+		opts.presenceField != ""}
 	if !mutuallyExclusive(encodePaths) {
 		return false
 	}
 
 	// Omit is mutually exclusive with everything else
-	otherThanOmit := (headerOpts || opts.varint || opts.optional)
+	otherThanOmit := (headerOpts || opts.varint || opts.optional || opts.selector != "" || opts.bits ||
+		opts.checksum || opts.presenceField != "")
 	if !mutuallyExclusive([]bool{opts.omit, otherThanOmit}) {
 		return false
 	}
 
+	// Group markers are mutually exclusive with everything else
+	groupMarker := opts.groupHeaderSize > 0 || opts.groupEnd
+	if groupMarker && (otherThanOmit || opts.omit || (opts.groupHeaderSize > 0 && opts.groupEnd)) {
+		return false
+	}
+
+	return true
+}
+
+// groupsBalanced verifies that every group end marker in a struct closes a
+// group opened earlier in the struct.  Groups left open at the end of the
+// struct extend to the end of the struct.
+func groupsBalanced(fieldOpts []fieldOptions) bool {
+	depth := 0
+	for _, opts := range fieldOpts {
+		switch {
+		case opts.groupHeaderSize > 0:
+			depth += 1
+		case opts.groupEnd:
+			depth -= 1
+		}
+
+		if depth < 0 {
+			return false
+		}
+	}
 	return true
 }
 
+func validVarintLength(n int) bool {
+	return n == 1 || n == 2 || n == 4 || n == 8
+}
+
 func (opts fieldOptions) ValidForType(t reflect.Type) bool {
-	headerType := t.Kind() == reflect.Slice || t.Kind() == reflect.Map
+	headerType := t.Kind() == reflect.Slice || t.Kind() == reflect.Map || t.Kind() == reflect.String ||
+		t == lazyType || t.Implements(framedMarshalerType) || reflect.PtrTo(t).Implements(appenderType)
 	headerTags := opts.omitHeader || opts.varintHeader || (opts.headerSize != 0) ||
-		(opts.minSize != 0) || (opts.maxSize != 0)
+		(opts.minSize != 0) || (opts.maxSize != 0) || opts.required || (opts.lengthBias != 0)
 	if headerTags && !headerType {
 		return false
 	}
 
-	uintRequired := opts.varint
-	if uintRequired {
+	opaqueRequired := opts.encoding != ""
+	if opaqueRequired && (t.Kind() != reflect.Slice || t.Elem().Kind() != reflect.Uint8) {
+		return false
+	}
+
+	fixedRequired := opts.fixedLength > 0
+	if fixedRequired && (t.Kind() != reflect.Slice || t.Elem().Kind() != reflect.Uint8) {
+		return false
+	}
+
+	stringRequired := opts.cstring || opts.charset != ""
+	if stringRequired && t.Kind() != reflect.String {
+		return false
+	}
+
+	// A fixed size applies to C strings, and sets the width of a bool
+	sizeRequired := opts.fixedSize > 0
+	if sizeRequired && t.Kind() != reflect.String && (t.Kind() != reflect.Bool || opts.fixedSize > 8) {
+		return false
+	}
+
+	// Every index of a sparse vector must fit in the index field
+	sliceRequired := opts.sparseLen > 0
+	if sliceRequired && (t.Kind() != reflect.Slice || opts.encoding != "" || opts.sparseLen > 1<<(8*sparseIndexSize)) {
+		return false
+	}
+
+	collectionRequired := opts.minCount > 0 || opts.maxCount > 0
+	if collectionRequired && t.Kind() != reflect.Slice && t.Kind() != reflect.Map {
+		return false
+	}
+
+	numericMapRequired := opts.numericKeys
+	if numericMapRequired && (t.Kind() != reflect.Map || (!isUintKind(t.Key().Kind()) && !isIntKind(t.Key().Kind()))) {
+		return false
+	}
+
+	vectorRequired := opts.lengthFrom != "" || opts.widthFrom != ""
+	if vectorRequired && t.Kind() != reflect.Slice && t.Kind() != reflect.String {
+		return false
+	}
+
+	intRequired := opts.varint
+	if intRequired {
 		switch t.Kind() {
 		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		default:
 			return false
 		}
 	}
 
-	ptrRequired := opts.optional
+	boolArrayRequired := opts.bits
+	if boolArrayRequired && (t.Kind() != reflect.Array || t.Elem().Kind() != reflect.Bool) {
+		return false
+	}
+
+	uint32Required := opts.checksum
+	if uint32Required && t.Kind() != reflect.Uint32 {
+		return false
+	}
+
+	ptrRequired := opts.optional || opts.presenceField != ""
 	if ptrRequired && t.Kind() != reflect.Ptr {
 		return false
 	}
 
+	// The absence marker must be written in place of a uint, so it must fit
+	uintPtrRequired := opts.absent != nil
+	if uintPtrRequired {
+		if t.Kind() != reflect.Ptr || !isUintKind(t.Elem().Kind()) {
+			return false
+		}
+
+		size := uint(t.Elem().Size())
+		if size < 8 && *opts.absent>>(8*size) > 0 {
+			return false
+		}
+	}
+
+	markerRequired := opts.groupHeaderSize > 0 || opts.groupEnd
+	if markerRequired && (t.Kind() != reflect.Struct || t.NumField() != 0) {
+		return false
+	}
+
+	// Byte order tags are not inherited by the fields of a struct
+	byteOrderTags := opts.littleEndian || opts.bigEndian
+	if byteOrderTags && !markerRequired && (t.Kind() == reflect.Struct || t.Kind() == reflect.Interface) {
+		return false
+	}
+
+	interfaceRequired := opts.selector != ""
+	if interfaceRequired && t.Kind() != reflect.Interface {
+		return false
+	}
+
 	return true
 }
 
@@ -97,12 +316,32 @@ var (
 	varintOption   = "varint"
 	optionalOption = "optional"
 	omitOption     = "omit"
+	requiredOption = "required"
+	cstringOption  = "cstring"
+	leOption       = "le"
+	beOption       = "be"
+	bitsOption     = "bits"
+	checksumOption = "checksum"
+
+	omitEmptyOption = "omitempty"
 
 	headOptionNone   = "none"
 	headOptionVarint = "varint"
+	headOptionAuto   = "auto"
+	maxHeaderSize    = 8
 	headValueNoHead  = uint(255)
 	headValueVarint  = uint(254)
 
+	groupOptionEnd = "end"
+
+	orderOptionEncoding = "encoding"
+	orderOptionNumeric  = "numeric"
+
+	sparseIndexSize = 2
+
+	encodingBase64 = "base64"
+	encodingHex    = "hex"
+
 	optionalFlagAbsent  uint8 = 0
 	optionalFlagPresent uint8 = 1
 )
@@ -117,9 +356,11 @@ func atoi(a string) int {
 
 // parseTag parses a struct field's "tls" tag as a comma-separated list of
 // name=value pairs, where the values MUST be unsigned integers, or in
-// the special case of head, "none" or "varint"
+// the special cases of head, "none" or "varint", of encoding, "base64" or
+// "hex", of select, a field name, and of group, "end"
 func parseTag(tag string) fieldOptions {
 	opts := fieldOptions{}
+	auto := false
 	for _, token := range strings.Split(tag, ",") {
 		parts := strings.Split(token, "=")
 
@@ -132,6 +373,20 @@ func parseTag(tag string) fieldOptions {
 				opts.optional = true
 			case omitOption:
 				opts.omit = true
+			case requiredOption:
+				opts.required = true
+			case cstringOption:
+				opts.cstring = true
+			case leOption:
+				opts.littleEndian = true
+			case beOption:
+				opts.bigEndian = true
+			case bitsOption:
+				opts.bits = true
+			case checksumOption:
+				opts.checksum = true
+			case omitEmptyOption:
+				opts.omitEmpty = true
 			default:
 				// XXX(rlb): Ignoring unknown fields
 			}
@@ -149,22 +404,126 @@ func parseTag(tag string) fieldOptions {
 			case parts[1] == headOptionNone:
 				opts.omitHeader = true
 			case parts[1] == headOptionVarint:
+				// Varint headers are always the minimal width for the
+				// encoded length, computed after the body is encoded.  The
+				// width is carried in the top bits of the header itself, so
+				// that the decoder does not need to be told it.
 				opts.varintHeader = true
+			case parts[1] == headOptionAuto:
+				// An automatic header is a fixed-width integer whose width
+				// is chosen after the body is encoded.  Since the width is
+				// not carried on the wire, it must be recorded in a
+				// companion field named by width-from.
+				auto = true
 			default:
 				opts.headerSize = atoi(parts[1])
+				if opts.headerSize < 1 || opts.headerSize > maxHeaderSize {
+					panic(fmt.Errorf("Invalid header size: %d (must be between 1 and %d)", opts.headerSize, maxHeaderSize))
+				}
 			}
 
 		case "min":
 			opts.minSize = atoi(parts[1])
 
+		case "absent":
+			absent, err := strconv.ParseUint(parts[1], 0, 64)
+			if err != nil {
+				panic(fmt.Errorf("Invalid absence marker: %v", err))
+			}
+			opts.absent = &absent
+
+		case "presence":
+			opts.presenceSize = atoi(parts[1])
+			if opts.presenceSize < 1 || opts.presenceSize > 8 {
+				panic(fmt.Errorf("Invalid presence size: %d (must be between 1 and 8)", opts.presenceSize))
+			}
+
+		case "bias":
+			opts.lengthBias = atoi(parts[1])
+
 		case "max":
 			opts.maxSize = atoi(parts[1])
 
+		case "mincount":
+			opts.minCount = atoi(parts[1])
+
+		case "maxcount":
+			opts.maxCount = atoi(parts[1])
+
+		case "pad":
+			opts.varintPad = atoi(parts[1])
+
+		case "size":
+			opts.fixedSize = atoi(parts[1])
+			if opts.fixedSize < 1 {
+				panic(fmt.Errorf("Invalid size: %d (must be positive)", opts.fixedSize))
+			}
+
+		case "order":
+			switch parts[1] {
+			case orderOptionEncoding:
+			case orderOptionNumeric:
+				opts.numericKeys = true
+			default:
+				panic(fmt.Errorf("Unknown key order: %s", parts[1]))
+			}
+
+		case "fixed":
+			opts.fixedLength = atoi(parts[1])
+
+		case "sparse":
+			opts.sparseLen = atoi(parts[1])
+
+		case "encoding":
+			switch parts[1] {
+			case encodingBase64, encodingHex:
+				opts.encoding = parts[1]
+			default:
+				panic(fmt.Errorf("Unknown encoding: %s", parts[1]))
+			}
+
+		case "select":
+			opts.selector = parts[1]
+
+		case "len-from":
+			opts.lengthFrom = parts[1]
+
+		case "width-from":
+			opts.widthFrom = parts[1]
+
+		case "present-if-bit":
+			opts.presenceField, opts.presenceBit = parsePresenceBit(parts[1])
+
+		case "charset":
+			lookupCharset(parts[1])
+			opts.charset = parts[1]
+
+		case "checksum-over":
+			opts.checksum = true
+			opts.checksumFirst, opts.checksumLast = parseChecksumRange(parts[1])
+
+		case "group":
+			if parts[1] == groupOptionEnd {
+				opts.groupEnd = true
+			} else {
+				opts.groupHeaderSize = atoi(parts[1])
+				if opts.groupHeaderSize < 1 || opts.groupHeaderSize > maxHeaderSize {
+					panic(fmt.Errorf("Invalid group header size: %d (must be between 1 and %d)", opts.groupHeaderSize, maxHeaderSize))
+				}
+			}
+
 		default:
 			// XXX(rlb): Ignoring unknown fields
 		}
 	}
 
+	if auto && opts.widthFrom == "" {
+		panic(fmt.Errorf("The head=auto tag requires a width-from field to record the header width"))
+	}
+	if opts.widthFrom != "" && !auto {
+		panic(fmt.Errorf("The width-from tag requires head=auto"))
+	}
+
 	if !opts.Consistent() {
 		panic(fmt.Errorf("Inconsistent options"))
 	}
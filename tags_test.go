@@ -29,6 +29,10 @@ func TestTagParsing(t *testing.T) {
 				maxSize:      60000,
 			},
 		},
+		{
+			encoded: "head=auto,width-from=Width",
+			opts:    fieldOptions{widthFrom: "Width"},
+		},
 		{
 			encoded: "head=none,min=3,max=60000",
 			opts: fieldOptions{
@@ -37,10 +41,88 @@ func TestTagParsing(t *testing.T) {
 				maxSize:    60000,
 			},
 		},
+		{
+			encoded: "head=2,min=1,required",
+			opts: fieldOptions{
+				headerSize: 2,
+				minSize:    1,
+				required:   true,
+			},
+		},
+		{
+			encoded: "head=2,encoding=base64",
+			opts: fieldOptions{
+				headerSize: 2,
+				encoding:   encodingBase64,
+			},
+		},
+		{
+			encoded: "head=2,sparse=16",
+			opts: fieldOptions{
+				headerSize: 2,
+				sparseLen:  16,
+			},
+		},
+		{
+			encoded: "select=Type",
+			opts:    fieldOptions{selector: "Type"},
+		},
 		{
 			encoded: "varint",
 			opts:    fieldOptions{varint: true},
 		},
+		{
+			encoded: "varint,pad=4",
+			opts:    fieldOptions{varint: true, varintPad: 4},
+		},
+		{
+			encoded: "group=3",
+			opts:    fieldOptions{groupHeaderSize: 3},
+		},
+		{
+			encoded: "group=end",
+			opts:    fieldOptions{groupEnd: true},
+		},
+		{
+			encoded: "head=2,le",
+			opts:    fieldOptions{headerSize: 2, littleEndian: true},
+		},
+		{
+			encoded: "size=16,cstring",
+			opts:    fieldOptions{fixedSize: 16, cstring: true},
+		},
+		{
+			encoded: "head=1,order=numeric",
+			opts:    fieldOptions{headerSize: 1, numericKeys: true},
+		},
+		{
+			encoded: "head=1,order=encoding",
+			opts:    fieldOptions{headerSize: 1},
+		},
+		{
+			encoded: "fixed=32",
+			opts:    fieldOptions{fixedLength: 32},
+		},
+		{
+			encoded: "head=1,bias=-1",
+			opts:    fieldOptions{headerSize: 1, lengthBias: -1},
+		},
+		{
+			encoded: "bits",
+			opts:    fieldOptions{bits: true},
+		},
+		{
+			encoded: "checksum-over=Type..Body",
+			opts:    fieldOptions{checksum: true, checksumFirst: "Type", checksumLast: "Body"},
+		},
+		{
+			encoded: "optional,presence=2",
+			opts:    fieldOptions{optional: true, presenceSize: 2},
+		},
+		{
+			encoded: "present-if-bit=Flags:3",
+			opts:    fieldOptions{presenceField: "Flags", presenceBit: 3},
+		},
 		{
 			encoded: "optional",
 			opts:    fieldOptions{optional: true},
@@ -60,6 +142,10 @@ func TestTagParsing(t *testing.T) {
 func TestTagConsistency(t *testing.T) {
 	cases := []string{
 		"head=3,head=none",
+		"head=1,head=none",
+		"head=0",
+		"head=9",
+		"optional,head=1",
 		"head=none,head=varint",
 		"head=varint,head=3",
 		"min=4,max=2",
@@ -67,6 +153,57 @@ func TestTagConsistency(t *testing.T) {
 		"varint,optional",
 		"optional,head=3",
 		"omit,varint",
+		"required,optional",
+		"encoding=base32",
+		"encoding=hex,varint",
+		"select=Type,varint",
+		"pad=4",
+		"varint,pad=3",
+		"group=2,head=2",
+		"group=2,group=end",
+		"cstring,size=-1",
+		"cstring,size=0",
+		"group=9",
+		"group=-1",
+		"group=0",
+		"sparse=16,varint",
+		"le,be",
+		"cstring",
+		"head=2,size=4,cstring",
+		"bits,head=2",
+		"checksum,varint",
+		"bias=-1",
+		"absent=0xFFFF",
+		"omitempty",
+		"head=2,omitempty",
+		"optional,absent=0xZZ",
+		"head=none,bias=-1",
+		"fixed=32,head=2",
+		"fixed=32,head=none",
+		"fixed=32,max=40",
+		"fixed=32,encoding=hex",
+		"fixed=32,varint",
+		"order=random",
+		"order=numeric,varint",
+		"checksum-over=Type",
+		"checksum-over=..Body",
+		"mincount=3,maxcount=2",
+		"maxcount=2,varint",
+		"len-from=Length,head=2",
+		"len-from=Length,varint",
+		"width-from=Width",
+		"head=auto",
+		"head=varint,width-from=Width",
+		"head=2,width-from=Width",
+		"head=auto,width-from=Width,len-from=Length",
+		"presence=2",
+		"optional,absent=0,presence=2",
+		"optional,presence=9",
+		"optional,presence=-1",
+		"optional,presence=0",
+		"present-if-bit=Flags",
+		"present-if-bit=Flags:64",
+		"present-if-bit=Flags:3,optional",
 	}
 
 	tryToParse := func(opts string) (err error) {
@@ -107,4 +244,39 @@ func TestTagValidity(t *testing.T) {
 	require.False(t, uintTags.ValidForType(sliceType))
 	require.False(t, ptrTags.ValidForType(uintType))
 	require.False(t, sliceTags.ValidForType(ptrType))
+
+	absentTags := parseTag("optional,absent=0xFFFF")
+	require.True(t, absentTags.ValidForType(reflect.TypeOf(new(uint16))))
+	require.False(t, absentTags.ValidForType(reflect.TypeOf(new(uint8))))
+	require.False(t, absentTags.ValidForType(reflect.TypeOf(new(string))))
+
+	bitsTags := parseTag("bits")
+	require.True(t, bitsTags.ValidForType(reflect.TypeOf([10]bool{})))
+	require.False(t, bitsTags.ValidForType(reflect.TypeOf([2]uint8{})))
+	require.False(t, bitsTags.ValidForType(sliceType))
+
+	countTags := parseTag("head=1,maxcount=4")
+	require.True(t, countTags.ValidForType(sliceType))
+	require.True(t, countTags.ValidForType(reflect.TypeOf(map[uint8]uint8{})))
+	require.False(t, countTags.ValidForType(reflect.TypeOf("")))
+
+	sizeTags := parseTag("size=4")
+	require.True(t, sizeTags.ValidForType(reflect.TypeOf(false)))
+	require.False(t, sizeTags.ValidForType(uintType))
+	require.False(t, parseTag("size=9").ValidForType(reflect.TypeOf(false)))
+
+	orderTags := parseTag("head=1,order=numeric")
+	require.True(t, orderTags.ValidForType(reflect.TypeOf(map[uint16]uint8{})))
+	require.True(t, orderTags.ValidForType(reflect.TypeOf(map[int32]uint8{})))
+	require.False(t, orderTags.ValidForType(reflect.TypeOf(map[string]uint8{})))
+	require.False(t, orderTags.ValidForType(sliceType))
+
+	sparseSliceType := reflect.TypeOf([]uint16{})
+	require.True(t, parseTag("head=2,sparse=65536").ValidForType(sparseSliceType))
+	require.False(t, parseTag("head=2,sparse=65537").ValidForType(sparseSliceType))
+
+	fixedTags := parseTag("fixed=32")
+	require.True(t, fixedTags.ValidForType(sliceType))
+	require.False(t, fixedTags.ValidForType(reflect.TypeOf([]uint16{})))
+	require.False(t, fixedTags.ValidForType(reflect.TypeOf("")))
 }